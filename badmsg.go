@@ -0,0 +1,51 @@
+package mtproto
+
+// handleBadMsg fixes what the server complained about and resends the message,
+// or fails the request if it can't be fixed.
+// https://core.telegram.org/mtproto/service_messages_about_messages#notice-of-ignored-error-message
+func (m *MTProto) handleBadMsg(msgId int64, data TL_crc_bad_msg_notification) {
+	switch data.error_code {
+	case 16, 17:
+		// msg_id too low or too high, the notification itself has the server time
+		m.clock.setServerTime(msgIdTime(msgId))
+		if data.error_code == 17 {
+			m.clock.rewind()
+		}
+		m.resend(data.bad_msg_id)
+
+	case 19, 20:
+		// msg_id of a container reused, or a message too old to be checked
+		m.resend(data.bad_msg_id)
+
+	case 32, 33:
+		// msg_seqno too low or too high: the server and we disagree about the session,
+		// so start a new one and send everything unacknowledged or unanswered there.
+		// Answers in the old session are dropped, so it is destroyed only after that.
+		m.newSession()
+		m.resendPending()
+		m.destroyStaleSessions()
+
+	case 48:
+		// the salt comes with bad_server_salt
+		m.resend(data.bad_msg_id)
+
+	default:
+		m.fail(data.bad_msg_id, BadMsgError{data.error_code})
+	}
+}
+
+// fail answers the request msgId with err. For a container every request in it is failed.
+func (m *MTProto) fail(msgId int64, err BadMsgError) {
+	m.mutex.Lock()
+	inner, ok := m.containers[msgId]
+	delete(m.containers, msgId)
+	m.mutex.Unlock()
+
+	if !ok {
+		m.answer(msgId, err)
+		return
+	}
+	for _, id := range inner {
+		m.answer(id, err)
+	}
+}
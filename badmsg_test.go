@@ -0,0 +1,87 @@
+package mtproto
+
+import "testing"
+
+func TestBadMsgResend(t *testing.T) {
+	m := newTestMTProto(nil)
+	resp := make(chan TL, 1)
+	msg := packetToSend{TL_ping{ping_id: 1}, resp}
+	m.msgsIdToAck[100] = msg
+	m.msgsIdToResp[100] = m.msgsIdToAck[100]
+
+	m.handleBadMsg(GenerateMessageId(), TL_crc_bad_msg_notification{bad_msg_id: 100, error_code: 20})
+
+	if _, ok := m.msgsIdToAck[100]; ok {
+		t.Fatal("Message is still waiting for an ack")
+	}
+	select {
+	case x := <-m.queueSend:
+		if x.resp != resp {
+			t.Fatal("Wrong message queued")
+		}
+	default:
+		t.Fatal("Message is not queued again")
+	}
+}
+
+func TestBadMsgError(t *testing.T) {
+	m := newTestMTProto(nil)
+	resp := make(chan TL, 1)
+	m.msgsIdToAck[100] = packetToSend{TL_ping{ping_id: 1}, resp}
+	m.msgsIdToResp[100] = m.msgsIdToAck[100]
+
+	m.handleBadMsg(GenerateMessageId(), TL_crc_bad_msg_notification{bad_msg_id: 100, error_code: 34})
+
+	x, ok := <-resp
+	if !ok {
+		t.Fatal("No answer")
+	}
+	if err, ok := x.(BadMsgError); !ok || err.Code != 34 {
+		t.Fatalf("Answer %#v", x)
+	}
+	if len(m.msgsIdToAck) != 0 || len(m.msgsIdToResp) != 0 {
+		t.Fatal("Request is not forgotten")
+	}
+}
+
+func TestBadMsgNewSession(t *testing.T) {
+	m := newTestMTProto(nil)
+	sessionId := m.sessionId
+	resp := make(chan TL, 1)
+	// acknowledged, but not answered
+	m.msgsIdToResp[100] = packetToSend{TL_help_getConfig{}, resp}
+
+	m.handleBadMsg(GenerateMessageId(), TL_crc_bad_msg_notification{bad_msg_id: 104, error_code: 32})
+
+	if m.sessionId == sessionId || len(m.msgsIdToResp) != 0 {
+		t.Fatal("Request is not moved to a new session")
+	}
+	if x := <-m.queueSend; x.resp != resp {
+		t.Errorf("Queued %#v before the unanswered request", x.msg)
+	}
+	if x, ok := (<-m.queueSend).msg.(TL_destroy_session); !ok || x.session_id != sessionId {
+		t.Errorf("Queued %#v instead of destroying the old session", x)
+	}
+}
+
+func TestBadMsgErrorContainer(t *testing.T) {
+	m := newTestMTProto(nil)
+	resps := []chan TL{make(chan TL, 1), make(chan TL, 1)}
+	for i, resp := range resps {
+		id := int64(100 + 4*i)
+		m.msgsIdToAck[id] = packetToSend{TL_help_getConfig{}, resp}
+		m.msgsIdToResp[id] = m.msgsIdToAck[id]
+	}
+	m.containers[108] = []int64{100, 104}
+
+	m.handleBadMsg(GenerateMessageId(), TL_crc_bad_msg_notification{bad_msg_id: 108, error_code: 64})
+
+	for i, resp := range resps {
+		if err, ok := (<-resp).(BadMsgError); !ok || err.Code != 64 {
+			t.Errorf("Request %d: answer %#v", i, err)
+		}
+	}
+	if len(m.msgsIdToAck) != 0 || len(m.msgsIdToResp) != 0 || len(m.containers) != 0 {
+		t.Error("Requests of the container are not forgotten")
+	}
+}
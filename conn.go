@@ -0,0 +1,150 @@
+package mtproto
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// delay before dialing the next address of a DC, see dialConn
+const dialStagger = 250 * time.Millisecond
+
+// packetConn carries whole MTProto packets between the session and the server.
+type packetConn interface {
+	WritePacket(data []byte, quickAck bool) error
+	ReadPacket() ([]byte, uint32, error)
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// streamConn frames packets with a Transport over a stream connection.
+type streamConn struct {
+	net.Conn
+	transport Transport
+}
+
+func (c *streamConn) WritePacket(data []byte, quickAck bool) error {
+	return c.transport.WritePacket(c.Conn, data, quickAck)
+}
+
+func (c *streamConn) ReadPacket() ([]byte, uint32, error) {
+	return c.transport.ReadPacket(c.Conn)
+}
+
+// dialConn opens a new connection to the current DC. Its addresses are dialed in parallel,
+// each one dialStagger after the previous (or right after it failed); the first connection
+// to complete the transport handshake wins and the others are dropped.
+func (m *MTProto) dialConn() (packetConn, error) {
+	addrs := m.candidateAddrs()
+	if m.httpScheme != "" || m.wsScheme == "wss" {
+		// nothing to race: requests are made on demand over HTTP,
+		// and WebSocket over TLS has a single host per DC
+		addrs = addrs[:1]
+	}
+
+	type result struct {
+		addr string
+		conn packetConn
+		err  error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan result, len(addrs))
+	next := 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		go func() {
+			conn, err := m.dialAddr(ctx, addr)
+			results <- result{addr, conn, err}
+		}()
+	}
+
+	start()
+	running := 1
+	stagger := time.NewTimer(dialStagger)
+	defer stagger.Stop()
+
+	var err error
+	for running > 0 {
+		select {
+		case <-stagger.C:
+			if next < len(addrs) {
+				start()
+				running++
+				stagger.Reset(dialStagger)
+			}
+
+		case r := <-results:
+			running--
+			if r.err == nil {
+				// close the connections which complete later
+				go func(running int) {
+					for i := 0; i < running; i++ {
+						if r := <-results; r.err == nil {
+							_ = r.conn.Close()
+						}
+					}
+				}(running)
+				m.addr = r.addr
+				return r.conn, nil
+			}
+			if err == nil {
+				err = r.err
+			}
+			if next < len(addrs) {
+				start()
+				running++
+				stagger.Reset(dialStagger)
+			}
+		}
+	}
+
+	return nil, err
+}
+
+func (m *MTProto) dialAddr(ctx context.Context, addr string) (packetConn, error) {
+	if m.httpScheme != "" {
+		return newHTTPConn(m.httpScheme, addr, m.dial), nil
+	}
+
+	if m.proxy != nil {
+		addr = m.proxy.addr
+	} else if m.wsScheme == "wss" {
+		var err error
+		addr, err = webSocketAddr(m.dcId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var conn net.Conn
+	var err error
+	if m.wsScheme != "" {
+		conn, err = dialWebSocket(ctx, m.dial, m.wsScheme, addr)
+	} else {
+		conn, err = m.dial(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	transport := m.newTransport()
+	if _, ok := transport.(*obfuscatedTransport); !ok && m.wsScheme != "" {
+		// web clients always obfuscate WebSocket traffic
+		transport = NewObfuscatedTransport(transport)
+	}
+	if m.proxy != nil {
+		conn, err = m.proxy.wrap(conn)
+		if err != nil {
+			return nil, err
+		}
+		transport = m.proxy.transport(transport, m.dcId)
+	}
+	err = transport.Init(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return &streamConn{conn, transport}, nil
+}
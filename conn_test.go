@@ -0,0 +1,74 @@
+package mtproto
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDialConnHappyEyeballs(t *testing.T) {
+	cancelled := make(chan struct{})
+	m := newTestMTProto(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		switch addr {
+		case "149.154.167.50:443":
+			// black hole
+			<-ctx.Done()
+			close(cancelled)
+			return nil, ctx.Err()
+		case "[2001:67c:4e8:f002::a]:443":
+			client, server := net.Pipe()
+			go io.Copy(io.Discard, server)
+			return client, nil
+		}
+		return nil, errors.New("unknown address")
+	})
+	m.dcs.reset([]TL_dcOption{
+		{id: 2, ip_address: "149.154.167.50", port: 443},
+		{id: 2, ipv6: true, ip_address: "2001:67c:4e8:f002::a", port: 443},
+	})
+
+	started := time.Now()
+	conn, err := m.dialConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if d := time.Since(started); d < dialStagger || d > 4*dialStagger {
+		t.Errorf("Connected after %s", d)
+	}
+	if m.addr != "[2001:67c:4e8:f002::a]:443" {
+		t.Errorf("Connected to %s", m.addr)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Error("Slow dial is not cancelled")
+	}
+}
+
+func TestDialConnAllFail(t *testing.T) {
+	dials := 0
+	m := newTestMTProto(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		return nil, errors.New("connection refused")
+	})
+	m.dcs.reset([]TL_dcOption{
+		{id: 2, ip_address: "149.154.167.51", port: 443},
+		{id: 2, ip_address: "149.154.167.52", port: 443},
+	})
+
+	started := time.Now()
+	if _, err := m.dialConn(); err == nil {
+		t.Fatal("No error")
+	}
+	// failures start the next attempt without waiting for the stagger
+	if d := time.Since(started); d > dialStagger {
+		t.Errorf("Failed after %s", d)
+	}
+	if dials != 3 {
+		t.Errorf("%d dials instead of 3", dials)
+	}
+}
@@ -0,0 +1,272 @@
+package mtproto
+
+const (
+	// limits of an outgoing msg_container
+	containerMaxMessages = 1020
+	containerMaxSize     = 1 << 15
+)
+
+// outMessage is a message of an outgoing packet with its msg_id and serialized body.
+type outMessage struct {
+	msgId int64
+	body  []byte
+	packetToSend
+}
+
+// outPacket is an encrypted packet ready to be written.
+type outPacket struct {
+	data     []byte
+	quickAck bool
+	// the followed requests in the packet
+	resps []chan TL
+}
+
+// rawTL is a serialized object.
+type rawTL []byte
+
+func (e rawTL) encode() []byte { return e }
+
+// contentRelated tells whether the server acknowledges msg, which also makes its seqno odd.
+func contentRelated(msg TL) bool {
+	switch msg.(type) {
+	case TL_ping, TL_msgs_ack, TL_http_wait:
+		return false
+	}
+	return true
+}
+
+// nextSeqNo returns the seqno of the next message. m.mutex must be held.
+// https://core.telegram.org/mtproto/description#message-sequence-number-msg-seqno
+func (m *MTProto) nextSeqNo(contentRelated bool) int32 {
+	if !contentRelated {
+		return m.lastSeqNo
+	}
+	seqNo := m.lastSeqNo | 1
+	m.lastSeqNo += 2
+	return seqNo
+}
+
+// mergeAcks puts the ids of every msgs_ack in msgs into a single msgs_ack at the end.
+func mergeAcks(msgs []packetToSend) []packetToSend {
+	res := make([]packetToSend, 0, len(msgs))
+	var ids []int64
+	for _, x := range msgs {
+		if ack, ok := x.msg.(TL_msgs_ack); ok {
+			ids = append(ids, ack.msgIds...)
+		} else {
+			res = append(res, x)
+		}
+	}
+	if len(ids) > 0 {
+		res = append(res, packetToSend{TL_msgs_ack{ids}, nil})
+	}
+	return res
+}
+
+// encodeBody serializes msg, compressed if it is a large request.
+func (m *MTProto) encodeBody(msg TL) []byte {
+	obj := msg.encode()
+	if m.gzipThreshold > 0 && len(obj) > m.gzipThreshold && contentRelated(msg) {
+		if packed := gzipPacked(obj); packed != nil {
+			return packed
+		}
+	}
+	return obj
+}
+
+// sendMessages sends msgs in as few packets as the container limits allow.
+// Every packet is registered before the first one is written, so the messages
+// which need an ack are resent after a reconnect even if a write fails.
+func (m *MTProto) sendMessages(msgs []packetToSend) error {
+	if !m.encrypted {
+		for _, x := range msgs {
+			err := m.sendPlain(x.msg)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	m.mutex.Lock()
+	live := msgs[:0:0]
+	for _, x := range msgs {
+		if _, ok := m.cancelled[x.resp]; ok {
+			// the caller gave up before the request was sent
+			delete(m.cancelled, x.resp)
+			continue
+		}
+		live = append(live, x)
+	}
+	m.mutex.Unlock()
+	if len(live) == 0 {
+		return nil
+	}
+
+	msgs = mergeAcks(live)
+	out := make([]outMessage, len(msgs))
+	for i, x := range msgs {
+		out[i] = outMessage{0, m.encodeBody(x.msg), x}
+	}
+
+	var packets []outPacket
+	for len(out) > 0 {
+		n, size := 1, len(out[0].body)
+		for n < len(out) && n < containerMaxMessages && size+16+len(out[n].body) <= containerMaxSize {
+			size += 16 + len(out[n].body)
+			n++
+		}
+		for i := 0; i < n; i++ {
+			out[i].msgId = m.clock.newMsgId()
+		}
+		p, err := m.packMessages(out[:n])
+		if err != nil {
+			return err
+		}
+		if p.data != nil {
+			packets = append(packets, p)
+		}
+		out = out[n:]
+	}
+
+	for _, p := range packets {
+		err := m.writePacket(p)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// packMessages encrypts msgs into a packet, in a msg_container if there are several of them,
+// and registers them for acks, answers and quick acks. Requests cancelled meanwhile are left out,
+// so the packet is empty if nothing remains.
+func (m *MTProto) packMessages(msgs []outMessage) (outPacket, error) {
+	m.mutex.Lock()
+	live := msgs[:0:0]
+	for _, x := range msgs {
+		if _, ok := m.cancelled[x.resp]; ok {
+			delete(m.cancelled, x.resp)
+			continue
+		}
+		live = append(live, x)
+	}
+	msgs = live
+	if len(msgs) == 0 {
+		m.mutex.Unlock()
+		return outPacket{}, nil
+	}
+	m.rotateSalt()
+	serverSalt, sessionId := m.serverSalt, m.sessionId
+	seqNos := make([]int32, len(msgs))
+	var inner []int64
+	for i, v := range msgs {
+		seqNos[i] = m.nextSeqNo(contentRelated(v.msg))
+		// registered along with the cancelled check, so that cancel finds
+		// every request which is not left out
+		track := contentRelated(v.msg)
+		switch req := v.msg.(type) {
+		case TL_msgs_state_req:
+			// state requests are made anew after a reconnect instead of being resent
+			m.stateReqs[v.msgId] = req.msg_ids
+			track = false
+		case TL_msg_resend_req, TL_msg_resend_ans_req, TL_destroy_session:
+			// answered without rpc_result, so they would wait for an ack forever
+			track = false
+		}
+		if track {
+			m.msgsIdToAck[v.msgId] = v.packetToSend
+			inner = append(inner, v.msgId)
+		}
+		if v.resp != nil {
+			// kept until answered, so that it can be resent in a new session
+			m.msgsIdToResp[v.msgId] = v.packetToSend
+		}
+	}
+	m.mutex.Unlock()
+
+	msgId, seqNo, obj := msgs[0].msgId, seqNos[0], msgs[0].body
+	if len(msgs) > 1 {
+		items := make([]TL_MT_message, len(msgs))
+		for i, x := range msgs {
+			items[i] = TL_MT_message{x.msgId, seqNos[i], int32(len(x.body)), rawTL(x.body)}
+		}
+		obj = TL_msg_container{items}.encode()
+		// the container is made after its contents, so its msg_id is greater
+		msgId = m.clock.newMsgId()
+		m.mutex.Lock()
+		seqNo = m.nextSeqNo(false)
+		m.mutex.Unlock()
+	}
+
+	z := NewEncodeBuf(256)
+	z.Bytes(serverSalt)
+	z.Long(sessionId)
+	z.Long(msgId)
+	z.Int(seqNo)
+	z.Int(int32(len(obj)))
+	z.Bytes(obj)
+
+	authKey, authKeyHash := m.sessionKey()
+	msgKey, encryptedData, token, err := encryptMessage(authKey, z.buf, m.mtproto2)
+	if err != nil {
+		return outPacket{}, err
+	}
+
+	x := NewEncodeBuf(256)
+	x.Bytes(authKeyHash)
+	x.Bytes(msgKey)
+	x.Bytes(encryptedData)
+	p := outPacket{data: x.buf}
+
+	m.mutex.Lock()
+	for _, v := range msgs {
+		if _, ok := m.respToStatus[v.resp]; ok {
+			// quick acks are only asked for requests someone follows
+			p.quickAck = true
+			p.resps = append(p.resps, v.resp)
+		}
+	}
+	if p.quickAck {
+		m.quickAcks[token] = p.resps
+	}
+	if len(msgs) > 1 && len(inner) > 0 {
+		m.addContainer(msgId, inner)
+	}
+	m.mutex.Unlock()
+
+	return p, nil
+}
+
+// writePacket writes p to the connection.
+func (m *MTProto) writePacket(p outPacket) error {
+	err := m.conn.WritePacket(p.data, p.quickAck)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	for _, resp := range p.resps {
+		m.setStatus(resp, StatusWritten)
+	}
+	m.mutex.Unlock()
+	return nil
+}
+
+// addContainer remembers the messages sent in the container msgId, so that they can be resent
+// when the server rejects the container. Containers whose messages were all acknowledged
+// are forgotten meanwhile. m.mutex must be held.
+func (m *MTProto) addContainer(msgId int64, inner []int64) {
+	for k, ids := range m.containers {
+		pending := false
+		for _, id := range ids {
+			if _, ok := m.msgsIdToAck[id]; ok {
+				pending = true
+				break
+			}
+		}
+		if !pending {
+			delete(m.containers, k)
+		}
+	}
+	m.containers[msgId] = inner
+}
@@ -0,0 +1,95 @@
+package mtproto
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSendContainer(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	m := newTestMTProto(nil)
+	m.conn = &streamConn{client, NewIntermediateTransport()}
+
+	resp1, resp2 := make(chan TL, 1), make(chan TL, 1)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- m.sendMessages([]packetToSend{
+			{TL_help_getConfig{}, resp1},
+			{TL_msgs_ack{[]int64{1}}, nil},
+			{TL_help_getConfig{}, resp2},
+			{TL_msgs_ack{[]int64{2}}, nil},
+		})
+	}()
+
+	x, _, err := NewIntermediateTransport().ReadPacket(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	y, err := decryptServerSide(m.authKey, x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	containerId := int64(binary.LittleEndian.Uint64(y[16:]))
+	if seqNo := binary.LittleEndian.Uint32(y[24:]); seqNo != 4 {
+		t.Errorf("Container seqno %d", seqNo)
+	}
+	c, ok := NewDecodeBuf(y[32:]).Object().(TL_msg_container)
+	if !ok || len(c.items) != 3 {
+		t.Fatalf("Sent %#v", c)
+	}
+	for i, seqNo := range []int32{1, 3, 4} {
+		if c.items[i].seq_no != seqNo || c.items[i].msg_id >= containerId {
+			t.Errorf("Message %d: msg_id %x seqno %d", i, c.items[i].msg_id, c.items[i].seq_no)
+		}
+	}
+	if ack, ok := c.items[2].data.(TL_msgs_ack); !ok || len(ack.msgIds) != 2 {
+		t.Errorf("Acks %#v", c.items[2].data)
+	}
+	if len(m.msgsIdToAck) != 2 || m.msgsIdToResp[c.items[1].msg_id].resp != resp2 {
+		t.Error("Messages are not tracked by their own msg_ids")
+	}
+
+	// a rejected container is resent message by message
+	m.process(GenerateMessageId()|1, 0, TL_bad_server_salt{containerId, 4, 48, GenerateNonce(8)})
+	if len(m.queueSend) != 2 || len(m.msgsIdToAck) != 0 {
+		t.Errorf("%d messages queued again", len(m.queueSend))
+	}
+}
+
+func TestSendContainerSizeLimit(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	m := newTestMTProto(nil)
+	m.conn = &streamConn{client, NewIntermediateTransport()}
+
+	big := rawTL(make([]byte, containerMaxSize/2))
+	errs := make(chan error, 1)
+	go func() {
+		errs <- m.sendMessages([]packetToSend{{big, nil}, {big, nil}})
+	}()
+
+	for i := 0; i < 2; i++ {
+		x, _, err := NewIntermediateTransport().ReadPacket(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		y, err := decryptServerSide(m.authKey, x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := binary.LittleEndian.Uint32(y[28:]); int(size) != len(big) {
+			t.Errorf("Packet %d: message of %d bytes", i, size)
+		}
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
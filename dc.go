@@ -0,0 +1,130 @@
+package mtproto
+
+import (
+	"net"
+	"strconv"
+	"sync"
+)
+
+type dcAddress struct {
+	addr      string
+	ipv6      bool
+	mediaOnly bool
+	tcpoOnly  bool
+}
+
+// dcTable keeps every known address of every DC, as announced in dc_options.
+type dcTable struct {
+	mutex      sync.Mutex
+	options    map[int32][]dcAddress
+	preferIPv6 bool
+}
+
+func newDcTable() *dcTable {
+	return &dcTable{options: make(map[int32][]dcAddress)}
+}
+
+func newDcAddress(v TL_dcOption) dcAddress {
+	return dcAddress{
+		net.JoinHostPort(v.ip_address, strconv.Itoa(int(v.port))),
+		v.ipv6,
+		v.media_only,
+		v.tcpo_only,
+	}
+}
+
+// reset replaces the table with dc_options from TL_config.
+func (t *dcTable) reset(options []TL_dcOption) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.options = make(map[int32][]dcAddress)
+	for _, v := range options {
+		t.options[v.id] = append(t.options[v.id], newDcAddress(v))
+	}
+}
+
+// merge applies dc_options from updateDcOptions: an address replaces the known one
+// with the same DC id and flags, other addresses are kept.
+func (t *dcTable) merge(options []TL_dcOption) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, v := range options {
+		x := newDcAddress(v)
+		list := t.options[v.id]
+		found := false
+		for i, y := range list {
+			if y.ipv6 == x.ipv6 && y.mediaOnly == x.mediaOnly && y.tcpoOnly == x.tcpoOnly {
+				list[i] = x
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.options[v.id] = append(list, x)
+		}
+	}
+}
+
+// addresses returns the addresses of a DC in the order they should be tried:
+// the preferred IP family first, and for media also media-only addresses first.
+// tcpo_only addresses are usable only with obfuscated transports.
+func (t *dcTable) addresses(id int32, media, obfuscated bool) []string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	rank := func(v dcAddress) int {
+		r := 0
+		if v.ipv6 != t.preferIPv6 {
+			r++
+		}
+		if media && !v.mediaOnly {
+			r += 2
+		}
+		return r
+	}
+
+	var res []string
+	for r := 0; r < 4; r++ {
+		for _, v := range t.options[id] {
+			if (v.mediaOnly && !media) || (v.tcpoOnly && !obfuscated) {
+				continue
+			}
+			if rank(v) == r {
+				res = append(res, v.addr)
+			}
+		}
+	}
+
+	return res
+}
+
+// DCAddresses returns the known addresses of a DC, best first.
+// Set media to route file transfers to media-only addresses where available.
+func (m *MTProto) DCAddresses(id int32, media bool) []string {
+	return m.dcs.addresses(id, media, m.obfuscated())
+}
+
+func (m *MTProto) obfuscated() bool {
+	if m.proxy != nil || m.wsScheme != "" {
+		return true
+	}
+	_, ok := m.newTransport().(*obfuscatedTransport)
+	return ok
+}
+
+// candidateAddrs lists the addresses to try for the current DC, starting with the last used one.
+func (m *MTProto) candidateAddrs() []string {
+	res := []string{m.addr}
+	if m.proxy != nil {
+		// the proxy picks the address itself
+		return res
+	}
+	for _, v := range m.dcs.addresses(m.dcId, false, m.obfuscated()) {
+		if v != m.addr {
+			res = append(res, v)
+		}
+	}
+	return res
+}
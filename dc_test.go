@@ -0,0 +1,46 @@
+package mtproto
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDcTable(t *testing.T) {
+	dcs := newDcTable()
+	dcs.reset([]TL_dcOption{
+		{id: 1, ip_address: "149.154.175.50", port: 443},
+		{id: 2, ip_address: "149.154.167.51", port: 443},
+		{id: 2, ipv6: true, ip_address: "2001:67c:4e8:f002::a", port: 443},
+		{id: 2, media_only: true, ip_address: "149.154.167.151", port: 443},
+		{id: 2, tcpo_only: true, ip_address: "149.154.167.52", port: 80},
+	})
+
+	cases := []struct {
+		preferIPv6, media, obfuscated bool
+		addrs                         []string
+	}{
+		{false, false, false, []string{"149.154.167.51:443", "[2001:67c:4e8:f002::a]:443"}},
+		{true, false, false, []string{"[2001:67c:4e8:f002::a]:443", "149.154.167.51:443"}},
+		{false, true, false, []string{"149.154.167.151:443", "149.154.167.51:443", "[2001:67c:4e8:f002::a]:443"}},
+		{false, false, true, []string{"149.154.167.51:443", "149.154.167.52:80", "[2001:67c:4e8:f002::a]:443"}},
+	}
+	for _, c := range cases {
+		dcs.preferIPv6 = c.preferIPv6
+		addrs := dcs.addresses(2, c.media, c.obfuscated)
+		if !reflect.DeepEqual(addrs, c.addrs) {
+			t.Errorf("ipv6=%t media=%t obfuscated=%t: got %v, want %v", c.preferIPv6, c.media, c.obfuscated, addrs, c.addrs)
+		}
+	}
+
+	dcs.preferIPv6 = false
+	dcs.merge([]TL_dcOption{
+		{id: 2, ip_address: "149.154.167.40", port: 443},
+		{id: 3, ip_address: "149.154.175.100", port: 443},
+	})
+	if addrs := dcs.addresses(2, false, false); !reflect.DeepEqual(addrs, []string{"149.154.167.40:443", "[2001:67c:4e8:f002::a]:443"}) {
+		t.Errorf("Merge: got %v", addrs)
+	}
+	if addrs := dcs.addresses(3, false, false); len(addrs) != 1 {
+		t.Errorf("Merge: got %v", addrs)
+	}
+}
@@ -0,0 +1,101 @@
+package mtproto
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+)
+
+// the dh_prime Telegram servers use
+const telegramDHPrime = "c71caeb9c6b1c9048e6c522f70f13f73980d40238e3e21c14934d037563d930f" +
+	"48198a0aa7c14058229493d22530f4dbfa336f6e0ac925139543aed44cce7c37" +
+	"20fd51f69458705ac68cd4fe6b6b13abdc9746512969328454f18faf8c595f64" +
+	"2477fe96bb2a941d5bcd1d4ac8cc49880708fa9b378e3c4f3a9060bee67cf9a4" +
+	"a4a695811051907e162753b56b0f6b410dba74d8a84b2a14b3144e0ef1284754" +
+	"fd17ed950d5965b4b9dd46582db1178d169c6bc465b0d6ff9ca3928fef5b9ae4" +
+	"e418fc15e83ebea0f87fa9ff5eed70050ded2849f47bf959d956850ce929851f" +
+	"0d8115f635b105ee2e4e15d04b2454bf6f4fadf034b10403119cd8e3b92fcc5b"
+
+// safePrimes caches the dh_prime values known to be safe primes,
+// so the costly primality test runs once per prime.
+var safePrimes = struct {
+	sync.Mutex
+	known map[string]bool
+}{known: make(map[string]bool)}
+
+func init() {
+	p, _ := new(big.Int).SetString(telegramDHPrime, 16)
+	safePrimes.known[string(p.Bytes())] = true
+}
+
+// checkDHParams validates the DH parameters sent by the server.
+// https://core.telegram.org/mtproto/security_guidelines#g-a-and-g-b-validation
+func checkDHParams(g int32, dhPrime, g_a *big.Int) error {
+	if dhPrime.BitLen() != 2048 {
+		return fmt.Errorf("Handshake: dh_prime is %d bits long", dhPrime.BitLen())
+	}
+	if !isSafePrime(dhPrime) {
+		return errors.New("Handshake: dh_prime is not a safe prime")
+	}
+	if !generatesSubgroup(g, dhPrime) {
+		return fmt.Errorf("Handshake: g = %d doesn't generate a subgroup of order (dh_prime-1)/2", g)
+	}
+	if !checkDHValue(g_a, dhPrime) {
+		return errors.New("Handshake: g_a is out of range")
+	}
+	return nil
+}
+
+func isSafePrime(p *big.Int) bool {
+	key := string(p.Bytes())
+	safePrimes.Lock()
+	ok := safePrimes.known[key]
+	safePrimes.Unlock()
+	if ok {
+		return true
+	}
+
+	q := new(big.Int).Rsh(p, 1)
+	if !p.ProbablyPrime(30) || !q.ProbablyPrime(30) {
+		return false
+	}
+
+	safePrimes.Lock()
+	safePrimes.known[key] = true
+	safePrimes.Unlock()
+	return true
+}
+
+// generatesSubgroup tells whether g is a quadratic residue mod p,
+// using the conditions from the auth key creation docs.
+func generatesSubgroup(g int32, p *big.Int) bool {
+	mod := func(n int64) int64 {
+		return new(big.Int).Mod(p, big.NewInt(n)).Int64()
+	}
+	switch g {
+	case 2:
+		return mod(8) == 7
+	case 3:
+		return mod(3) == 2
+	case 4:
+		return true
+	case 5:
+		r := mod(5)
+		return r == 1 || r == 4
+	case 6:
+		r := mod(24)
+		return r == 19 || r == 23
+	case 7:
+		r := mod(7)
+		return r == 3 || r == 5 || r == 6
+	}
+	return false
+}
+
+// checkDHValue tells whether g_a or g_b lies in [2^(2048-64), dh_prime - 2^(2048-64)].
+func checkDHValue(x, dhPrime *big.Int) bool {
+	min := new(big.Int).Lsh(big.NewInt(1), 2048-64)
+	max := new(big.Int).Sub(dhPrime, min)
+	return x.Cmp(min) >= 0 && x.Cmp(max) <= 0
+}
@@ -0,0 +1,61 @@
+package mtproto
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestCheckDHParams(t *testing.T) {
+	p, _ := new(big.Int).SetString(telegramDHPrime, 16)
+	g_a := new(big.Int).Exp(big.NewInt(3), new(big.Int).SetBytes(GenerateNonce(256)), p)
+	if err := checkDHParams(3, p, g_a); err != nil {
+		t.Fatal(err)
+	}
+
+	// the cache is skipped for a prime seen for the first time
+	q := new(big.Int).Add(p, big.NewInt(2))
+	if isSafePrime(q) {
+		t.Error("dh_prime+2 is a safe prime")
+	}
+	safePrimes.Lock()
+	delete(safePrimes.known, string(p.Bytes()))
+	safePrimes.Unlock()
+	if !isSafePrime(p) {
+		t.Error("dh_prime is not a safe prime")
+	}
+
+	min := new(big.Int).Lsh(big.NewInt(1), 2048-64)
+	tests := []struct {
+		name string
+		g    int32
+		p    *big.Int
+		g_a  *big.Int
+	}{
+		{"short prime", 3, new(big.Int).Rsh(p, 1), g_a},
+		{"not a safe prime", 3, q, g_a},
+		{"g = 2", 2, p, g_a},
+		{"g = 9", 9, p, g_a},
+		{"g_a = 2", 3, p, big.NewInt(2)},
+		{"small g_a", 3, p, new(big.Int).Sub(min, big.NewInt(1))},
+		{"large g_a", 3, p, new(big.Int).Sub(p, big.NewInt(2))},
+	}
+	for _, test := range tests {
+		if checkDHParams(test.g, test.p, test.g_a) == nil {
+			t.Errorf("%s: accepted", test.name)
+		}
+	}
+}
+
+func TestMakeGAB(t *testing.T) {
+	p, _ := new(big.Int).SetString(telegramDHPrime, 16)
+	a := new(big.Int).SetBytes(GenerateNonce(256))
+	g_a := new(big.Int).Exp(big.NewInt(3), a, p)
+
+	_, g_b, g_ab := makeGAB(3, g_a, p)
+	if !checkDHValue(g_b, p) {
+		t.Error("g_b is out of range")
+	}
+	if new(big.Int).Exp(g_b, a, p).Cmp(g_ab) != 0 {
+		t.Error("Keys differ")
+	}
+}
@@ -0,0 +1,246 @@
+package mtproto
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const dialTimeout = 30 * time.Second
+
+// DialContextFunc opens a stream connection to addr, like net.Dialer.DialContext.
+type DialContextFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func defaultDialer(forward DialContextFunc) DialContextFunc {
+	if forward != nil {
+		return forward
+	}
+	return (&net.Dialer{Timeout: dialTimeout}).DialContext
+}
+
+// SOCKS5Dialer returns a dialer which connects through the SOCKS5 proxy at proxyAddr.
+// Username and password are used only if username is not empty. A nil forward dials the proxy directly.
+func SOCKS5Dialer(proxyAddr, username, password string, forward DialContextFunc) DialContextFunc {
+	forward = defaultDialer(forward)
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := forward(ctx, network, proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		err = withDeadline(ctx, conn, func() error {
+			return socks5Connect(conn, addr, username, password)
+		})
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+// https://tools.ietf.org/html/rfc1928
+func socks5Connect(conn net.Conn, addr, username, password string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("SOCKS5: wrong port %q", portStr)
+	}
+
+	// greeting
+	method := byte(0x00)
+	if username != "" {
+		method = 0x02
+	}
+	_, err = conn.Write([]byte{0x05, 0x01, method})
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 2)
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		return err
+	}
+	if b[0] != 0x05 || b[1] != method {
+		return errors.New("SOCKS5: authentication method rejected")
+	}
+
+	// https://tools.ietf.org/html/rfc1929
+	if method == 0x02 {
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5: username or password too long")
+		}
+		x := []byte{0x01, byte(len(username))}
+		x = append(x, username...)
+		x = append(x, byte(len(password)))
+		x = append(x, password...)
+		_, err = conn.Write(x)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, b)
+		if err != nil {
+			return err
+		}
+		if b[0] != 0x01 {
+			return fmt.Errorf("SOCKS5: wrong authentication version %d", b[0])
+		}
+		if b[1] != 0x00 {
+			return errors.New("SOCKS5: authentication failed")
+		}
+	}
+
+	// connect
+	x := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("SOCKS5: host name too long")
+		}
+		x = append(x, 0x03, byte(len(host)))
+		x = append(x, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		x = append(x, 0x01)
+		x = append(x, ip4...)
+	} else {
+		x = append(x, 0x04)
+		x = append(x, ip...)
+	}
+	x = append(x, byte(port>>8), byte(port))
+	_, err = conn.Write(x)
+	if err != nil {
+		return err
+	}
+
+	b = make([]byte, 4)
+	_, err = io.ReadFull(conn, b)
+	if err != nil {
+		return err
+	}
+	if b[0] != 0x05 {
+		return errors.New("SOCKS5: wrong reply version")
+	}
+	if b[1] != 0x00 {
+		return fmt.Errorf("SOCKS5: connect failed with code %d", b[1])
+	}
+
+	// skip the bound address
+	var size int
+	switch b[3] {
+	case 0x01:
+		size = net.IPv4len
+	case 0x04:
+		size = net.IPv6len
+	case 0x03:
+		_, err = io.ReadFull(conn, b[:1])
+		if err != nil {
+			return err
+		}
+		size = int(b[0])
+	default:
+		return fmt.Errorf("SOCKS5: wrong address type %d", b[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, size+2))
+	return err
+}
+
+// HTTPConnectDialer returns a dialer which tunnels connections through the HTTP proxy at proxyAddr
+// using the CONNECT method. Basic authentication is used only if username is not empty.
+// A nil forward dials the proxy directly.
+func HTTPConnectDialer(proxyAddr, username, password string, forward DialContextFunc) DialContextFunc {
+	forward = defaultDialer(forward)
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := forward(ctx, network, proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		var br *bufio.Reader
+		err = withDeadline(ctx, conn, func() (err error) {
+			br, err = httpConnect(conn, addr, username, password)
+			return
+		})
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		if br.Buffered() > 0 {
+			return &bufferedConn{conn, br}, nil
+		}
+		return conn, nil
+	}
+}
+
+func httpConnect(conn net.Conn, addr, username, password string) (*bufio.Reader, error) {
+	req := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	req += "\r\n"
+	_, err := io.WriteString(conn, req)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP CONNECT: %s", resp.Status)
+	}
+
+	return br, nil
+}
+
+// withDeadline runs a proxy handshake bounded by the context deadline.
+func withDeadline(ctx context.Context, conn net.Conn, f func() error) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(dialTimeout)
+	}
+	err := conn.SetDeadline(deadline)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	err = f()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return err
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// bufferedConn returns bytes read ahead by the proxy handshake before reading from the connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
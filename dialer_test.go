@@ -0,0 +1,114 @@
+package mtproto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// pipeDialer returns a dialer which hands out one end of a pipe and serves the other end.
+func pipeDialer(serve func(net.Conn) error, done chan<- error) DialContextFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		go func() {
+			done <- serve(server)
+		}()
+		return client, nil
+	}
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	done := make(chan error, 1)
+	dial := SOCKS5Dialer("proxy:1080", "user", "pass", pipeDialer(func(conn net.Conn) error {
+		expect := func(b []byte) error {
+			x := make([]byte, len(b))
+			if _, err := io.ReadFull(conn, x); err != nil {
+				return err
+			}
+			if !bytes.Equal(x, b) {
+				return io.ErrUnexpectedEOF
+			}
+			return nil
+		}
+		if err := expect([]byte{0x05, 0x01, 0x02}); err != nil {
+			return err
+		}
+		conn.Write([]byte{0x05, 0x02})
+		if err := expect([]byte{0x01, 0x04, 'u', 's', 'e', 'r', 0x04, 'p', 'a', 's', 's'}); err != nil {
+			return err
+		}
+		conn.Write([]byte{0x01, 0x00})
+		if err := expect([]byte{0x05, 0x01, 0x00, 0x01, 149, 154, 167, 50, 0x01, 0xbb}); err != nil {
+			return err
+		}
+		conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		_, err := conn.Write([]byte("data"))
+		return err
+	}, done))
+
+	conn, err := dial(context.Background(), "tcp", "149.154.167.50:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err = io.ReadFull(conn, b); err != nil || string(b) != "data" {
+		t.Fatalf("Tunnel read failed: %q %v", b, err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSOCKS5WrongAuthVersion(t *testing.T) {
+	done := make(chan error, 1)
+	dial := SOCKS5Dialer("proxy:1080", "user", "pass", pipeDialer(func(conn net.Conn) error {
+		io.ReadFull(conn, make([]byte, 3))
+		conn.Write([]byte{0x05, 0x02})
+		io.ReadFull(conn, make([]byte, 11))
+		// a SOCKS5 reply instead of the RFC 1929 one
+		_, err := conn.Write([]byte{0x05, 0x00})
+		return err
+	}, done))
+
+	if _, err := dial(context.Background(), "tcp", "149.154.167.50:443"); err == nil {
+		t.Error("Wrong authentication reply accepted")
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPConnectDialer(t *testing.T) {
+	done := make(chan error, 1)
+	dial := HTTPConnectDialer("proxy:3128", "user", "pass", pipeDialer(func(conn net.Conn) error {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return err
+		}
+		if req.Method != "CONNECT" || req.Host != "149.154.167.50:443" {
+			return io.ErrUnexpectedEOF
+		}
+		if req.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			return io.ErrUnexpectedEOF
+		}
+		// the tunneled data comes in the same segment as the response
+		_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\ndata"))
+		return err
+	}, done))
+
+	conn, err := dial(context.Background(), "tcp", "149.154.167.50:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err = io.ReadFull(conn, b); err != nil || string(b) != "data" {
+		t.Fatalf("Tunnel read failed: %q %v", b, err)
+	}
+}
@@ -0,0 +1,77 @@
+package mtproto
+
+import (
+	"errors"
+	"fmt"
+)
+
+// https://core.telegram.org/mtproto/mtproto-transports#transport-errors
+const (
+	TransportErrorAuthKeyNotFound = -404
+	TransportErrorFlood           = -429
+	TransportErrorInvalidDC       = -444
+)
+
+// TransportError is the 4-byte error code the server sends instead of a packet.
+type TransportError struct {
+	Code int32
+}
+
+func (e TransportError) Error() string {
+	switch e.Code {
+	case TransportErrorAuthKeyNotFound:
+		return "Transport error -404: auth key not found"
+	case TransportErrorFlood:
+		return "Transport error -429: too many connections"
+	case TransportErrorInvalidDC:
+		return "Transport error -444: invalid DC"
+	}
+	return fmt.Sprintf("Transport error %d", e.Code)
+}
+
+// The server refused to create an auth key, see HandshakeError.
+var (
+	ErrDHParamsFail = errors.New("Handshake: server_DH_params_fail")
+	ErrDHGenFail    = errors.New("Handshake: dh_gen_fail")
+	ErrDHGenRetry   = errors.New("Handshake: too many dh_gen_retry")
+)
+
+// errMessageDropped is returned by readMessage for a message which is ignored.
+var errMessageDropped = errors.New("Message dropped")
+
+// HandshakeError is returned when the server refused every attempt to create an auth key.
+type HandshakeError struct {
+	Attempts int
+	// the failure of the last attempt
+	Err error
+}
+
+func (e HandshakeError) Error() string {
+	return fmt.Sprintf("Handshake failed after %d attempts: %s", e.Attempts, e.Err)
+}
+
+func (e HandshakeError) Unwrap() error {
+	return e.Err
+}
+
+// BadMsgError is the answer to a request the server rejected with bad_msg_notification
+// when resending it can't help.
+type BadMsgError struct {
+	Code int32
+}
+
+func (e BadMsgError) Error() string {
+	switch e.Code {
+	case 18:
+		return "Bad message 18: wrong lower bits of msg_id"
+	case 34:
+		return "Bad message 34: odd msg_seqno for a message which is not content-related"
+	case 35:
+		return "Bad message 35: even msg_seqno for a content-related message"
+	case 64:
+		return "Bad message 64: invalid container"
+	}
+	return fmt.Sprintf("Bad message %d", e.Code)
+}
+
+func (e BadMsgError) encode() []byte { return nil }
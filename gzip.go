@@ -0,0 +1,50 @@
+package mtproto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	// outgoing messages larger than this are sent as gzip_packed if that is shorter
+	defaultGzipThreshold = 1024
+	// inbound gzip_packed objects larger than this when unpacked are rejected
+	gunzipMaxSize = 16 << 20
+)
+
+// gzipPacked returns obj wrapped in gzip_packed, or nil if that doesn't save bytes.
+func gzipPacked(obj []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, _ = gz.Write(obj)
+	if gz.Close() != nil {
+		return nil
+	}
+
+	x := NewEncodeBuf(buf.Len() + 8)
+	x.UInt(crc_gzip_packed)
+	x.StringBytes(buf.Bytes())
+	if len(x.buf) >= len(obj) {
+		return nil
+	}
+	return x.buf
+}
+
+// gunzip unpacks the data of a gzip_packed object.
+func gunzip(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	obj, err := ioutil.ReadAll(io.LimitReader(gz, gunzipMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(obj) > gunzipMaxSize {
+		return nil, errors.New("Unpacked object is too large")
+	}
+	return obj, nil
+}
@@ -0,0 +1,58 @@
+package mtproto
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+func TestGzipPacked(t *testing.T) {
+	obj := TL_rpc_error{400, strings.Repeat("FLOOD", 1000)}
+	e := NewEncodeBuf(8192)
+	e.UInt(crc_rpc_error)
+	e.Int(obj.error_code)
+	e.String(obj.error_message)
+
+	packed := gzipPacked(e.buf)
+	if packed == nil || len(packed) >= len(e.buf) {
+		t.Fatal("Not compressed")
+	}
+	x, ok := NewDecodeBuf(packed).Object().(TL_rpc_error)
+	if !ok || x != obj {
+		t.Errorf("Unpacked %#v", x)
+	}
+
+	if gzipPacked(GenerateNonce(64)) != nil {
+		t.Error("Random data compressed")
+	}
+}
+
+func TestGunzipErrors(t *testing.T) {
+	var big bytes.Buffer
+	gz := gzip.NewWriter(&big)
+	gz.Write(make([]byte, gunzipMaxSize+1))
+	gz.Close()
+
+	var small bytes.Buffer
+	gz = gzip.NewWriter(&small)
+	gz.Write(make([]byte, 4096))
+	gz.Close()
+	// wrong CRC-32
+	corrupt := small.Bytes()
+	corrupt[len(corrupt)-6] ^= 0xff
+	for name, data := range map[string][]byte{
+		"not gzip":  GenerateNonce(64),
+		"truncated": big.Bytes()[:big.Len()/2],
+		"too large": big.Bytes(),
+		"corrupt":   corrupt,
+	} {
+		e := NewEncodeBuf(len(data) + 8)
+		e.UInt(crc_gzip_packed)
+		e.StringBytes(data)
+		d := NewDecodeBuf(e.buf)
+		if x := d.Object(); x != nil || d.err == nil {
+			t.Errorf("%s: decoded %#v", name, x)
+		}
+	}
+}
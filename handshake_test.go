@@ -0,0 +1,153 @@
+package mtproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// dhServer answers set_client_DH_params the way the server does.
+type dhServer struct {
+	conn        net.Conn
+	nonce       []byte
+	newNonce    []byte
+	serverNonce []byte
+	aesKey      []byte
+	aesIV       []byte
+	a           *big.Int
+	dhi         TL_server_DH_inner_data
+}
+
+func newDHServer(t *testing.T, conn net.Conn) *dhServer {
+	p, _ := new(big.Int).SetString(telegramDHPrime, 16)
+	s := &dhServer{
+		conn:        conn,
+		nonce:       GenerateNonce(16),
+		newNonce:    GenerateNonce(32),
+		serverNonce: GenerateNonce(16),
+		aesKey:      GenerateNonce(32),
+		aesIV:       GenerateNonce(32),
+		a:           new(big.Int).SetBytes(GenerateNonce(256)),
+	}
+	s.dhi = TL_server_DH_inner_data{s.nonce, s.serverNonce, 3, p, new(big.Int).Exp(big.NewInt(3), s.a, p), 0}
+	return s
+}
+
+// readClientDH returns the key the client made and its retry_id.
+func (s *dhServer) readClientDH(t *testing.T) ([]byte, int64) {
+	x, _, err := NewAbridgedTransport().ReadPacket(s.conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecodeBuf(x[20:])
+	if d.UInt() != crc_set_client_DH_params {
+		t.Fatal("Need set_client_DH_params")
+	}
+	_, _ = d.Bytes(16), d.Bytes(16)
+	y, err := doAES256IGEdecrypt(d.StringBytes(), s.aesKey, s.aesIV)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = NewDecodeBuf(y[20:])
+	if d.UInt() != crc_client_DH_inner_data {
+		t.Fatal("Need client_DH_inner_data")
+	}
+	_, _ = d.Bytes(16), d.Bytes(16)
+	retryId := d.Long()
+	g_b := d.BigInt()
+	if !bytes.Equal(sha1(y[20:20+d.off]), y[:20]) {
+		t.Error("Wrong client_DH_inner_data hash")
+	}
+	return new(big.Int).Exp(g_b, s.a, s.dhi.dh_prime).Bytes(), retryId
+}
+
+func (s *dhServer) answer(t *testing.T, crc uint32, hash []byte) {
+	x := NewEncodeBuf(128)
+	x.Long(0)
+	x.Long(GenerateMessageId() | 1)
+	x.Int(4 + 16 + 16 + 16)
+	x.UInt(crc)
+	x.Bytes(s.nonce)
+	x.Bytes(s.serverNonce)
+	x.Bytes(hash)
+	if err := NewAbridgedTransport().WritePacket(s.conn, x.buf, false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *dhServer) run(m *MTProto) chan error {
+	done := make(chan error, 1)
+	go func() {
+		authKey, err := m.setClientDHParams(s.nonce, s.serverNonce, s.newNonce, s.aesKey, s.aesIV, s.dhi)
+		if err == nil {
+			m.authKey = authKey
+		}
+		done <- err
+	}()
+	return done
+}
+
+func TestDHGenRetry(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(10 * time.Second))
+	m := &MTProto{conn: &streamConn{client, NewAbridgedTransport()}}
+	s := newDHServer(t, server)
+	done := s.run(m)
+
+	key1, retryId := s.readClientDH(t)
+	if retryId != 0 {
+		t.Errorf("First retry_id is %d", retryId)
+	}
+	s.answer(t, crc_dh_gen_retry, newNonceHash(s.newNonce, 2, key1))
+
+	key2, retryId := s.readClientDH(t)
+	if retryId != int64(binary.LittleEndian.Uint64(sha1(key1)[0:8])) {
+		t.Error("retry_id is not auth_key_aux_hash of the first key")
+	}
+	s.answer(t, crc_dh_gen_ok, newNonceHash(s.newNonce, 1, key2))
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.authKey, key2) {
+		t.Error("Wrong auth key")
+	}
+}
+
+func TestDHGenFail(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(10 * time.Second))
+	m := &MTProto{conn: &streamConn{client, NewAbridgedTransport()}}
+
+	// a genuine dh_gen_fail
+	s := newDHServer(t, server)
+	done := s.run(m)
+	key, _ := s.readClientDH(t)
+	s.answer(t, crc_dh_gen_fail, newNonceHash(s.newNonce, 3, key))
+	if err := <-done; err != ErrDHGenFail {
+		t.Errorf("Got %v", err)
+	}
+
+	// an answer which doesn't prove the knowledge of the key
+	done = s.run(m)
+	s.readClientDH(t)
+	s.answer(t, crc_dh_gen_ok, GenerateNonce(16))
+	if err := <-done; err == nil || err == ErrDHGenFail {
+		t.Errorf("Got %v", err)
+	}
+
+	// the server asks to retry forever
+	done = s.run(m)
+	for i := 0; i < dhGenRetries; i++ {
+		key, _ = s.readClientDH(t)
+		s.answer(t, crc_dh_gen_retry, newNonceHash(s.newNonce, 2, key))
+	}
+	if err := <-done; err != ErrDHGenRetry {
+		t.Errorf("Got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package mtproto
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how long the server may hold a long-poll request, milliseconds
+const httpWaitMax = 25000
+
+type httpResult struct {
+	data []byte
+	err  error
+}
+
+// httpConn sends every packet as a POST to /api; answers come in the response bodies.
+// https://core.telegram.org/mtproto#http-transport
+type httpConn struct {
+	client *http.Client
+	url    string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	incoming chan httpResult
+	// signaled when no request is in flight and the server can't reach us
+	idle chan struct{}
+
+	mutex    sync.Mutex
+	pending  int
+	deadline time.Time
+}
+
+func newHTTPConn(scheme, addr string, dial DialContextFunc) *httpConn {
+	c := &httpConn{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:     dial,
+				IdleConnTimeout: 90 * time.Second,
+			},
+		},
+		url:      scheme + "://" + addr + "/api",
+		incoming: make(chan httpResult, 64),
+		idle:     make(chan struct{}, 1),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	return c
+}
+
+// WritePacket ignores quickAck, the answer to the POST request confirms the delivery anyway.
+func (c *httpConn) WritePacket(data []byte, quickAck bool) error {
+	select {
+	case <-c.ctx.Done():
+		return errors.New("HTTP: connection closed")
+	default:
+	}
+
+	c.mutex.Lock()
+	c.pending++
+	c.mutex.Unlock()
+
+	go c.post(data)
+
+	return nil
+}
+
+func (c *httpConn) post(data []byte) {
+	x, err := c.do(data)
+
+	c.mutex.Lock()
+	c.pending--
+	idle := c.pending == 0
+	c.mutex.Unlock()
+
+	if err != nil || len(x) > 0 {
+		select {
+		case c.incoming <- httpResult{x, err}:
+		case <-c.ctx.Done():
+			return
+		}
+	}
+	if idle {
+		select {
+		case c.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (c *httpConn) do(data []byte) ([]byte, error) {
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(c.ctx)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	x, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxPacketSize))
+	if err != nil {
+		return nil, err
+	}
+	// transport errors may come with an error status and a 4-byte code
+	if resp.StatusCode != http.StatusOK {
+		if len(x) == 4 {
+			// only the code tells that the auth key is gone, a 404 page
+			// of a proxy on the way must not cost the key
+			code := int32(binary.LittleEndian.Uint32(x))
+			if resp.StatusCode != http.StatusNotFound || code == TransportErrorAuthKeyNotFound {
+				return x, nil
+			}
+		} else if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, TransportError{TransportErrorFlood}
+		}
+		return nil, fmt.Errorf("HTTP: %s", resp.Status)
+	}
+
+	return x, nil
+}
+
+func (c *httpConn) ReadPacket() ([]byte, uint32, error) {
+	c.mutex.Lock()
+	deadline := c.deadline
+	c.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case r := <-c.incoming:
+		return r.data, 0, r.err
+	case <-timeout:
+		return nil, 0, errors.New("HTTP: read timeout")
+	case <-c.ctx.Done():
+		return nil, 0, errors.New("HTTP: connection closed")
+	}
+}
+
+func (c *httpConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.deadline = t
+	c.mutex.Unlock()
+	return nil
+}
+
+func (c *httpConn) Close() error {
+	c.cancel()
+	return nil
+}
@@ -0,0 +1,86 @@
+package mtproto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPConn(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		switch string(b) {
+		case "wait":
+			// long poll expired without messages
+		case "flood":
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte{0x53, 0xfe, 0xff, 0xff})
+		case "no key":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte{0x6c, 0xfe, 0xff, 0xff})
+		case "not found":
+			http.NotFound(w, r)
+		default:
+			w.Write(bytes.ToUpper(b))
+		}
+	}))
+	defer server.Close()
+
+	c := newHTTPConn("http", strings.TrimPrefix(server.URL, "http://"), defaultDialer(nil))
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	if err := c.WritePacket([]byte("wait"), false); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.idle:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No idle signal")
+	}
+
+	if err := c.WritePacket([]byte("packet"), false); err != nil {
+		t.Fatal(err)
+	}
+	x, _, err := c.ReadPacket()
+	if err != nil || string(x) != "PACKET" {
+		t.Fatalf("Got %q %v", x, err)
+	}
+
+	if err = c.WritePacket([]byte("flood"), false); err != nil {
+		t.Fatal(err)
+	}
+	x, _, err = c.ReadPacket()
+	if err != nil || len(x) != 4 {
+		t.Fatalf("Got %q %v", x, err)
+	}
+
+	if err = c.WritePacket([]byte("no key"), false); err != nil {
+		t.Fatal(err)
+	}
+	x, _, err = c.ReadPacket()
+	if err != nil || len(x) != 4 {
+		t.Fatalf("Got %q %v", x, err)
+	}
+
+	// a 404 page is not the auth key error
+	if err = c.WritePacket([]byte("not found"), false); err != nil {
+		t.Fatal(err)
+	}
+	if x, _, err = c.ReadPacket(); err == nil || err.Error() != "HTTP: 404 Not Found" {
+		t.Fatalf("Got %q %v", x, err)
+	}
+
+	c.Close()
+	if _, _, err = c.ReadPacket(); err == nil {
+		t.Error("Read from closed connection")
+	}
+}
@@ -0,0 +1,53 @@
+package mtproto
+
+import "context"
+
+// Invoke sends msg and waits for the answer. Answers which are errors, like BadMsgError,
+// are returned as such. If ctx is done first, the server is asked to drop the answer
+// with rpc_drop_answer and ctx.Err() is returned.
+func (m *MTProto) Invoke(ctx context.Context, msg TL) (TL, error) {
+	resp := make(chan TL, 1)
+	select {
+	case m.queueSend <- packetToSend{msg, resp}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case x := <-resp:
+		if err, ok := x.(error); ok {
+			return nil, err
+		}
+		return x, nil
+	case <-ctx.Done():
+		m.cancel(resp)
+		return nil, ctx.Err()
+	}
+}
+
+// cancel forgets the request answered to resp.
+// https://core.telegram.org/mtproto/service_messages#cancellation-of-an-rpc-query
+func (m *MTProto) cancel(resp chan TL) {
+	m.mutex.Lock()
+	var msgId int64
+	for k, v := range m.msgsIdToResp {
+		if v.resp == resp {
+			msgId = k
+			delete(m.msgsIdToResp, k)
+			delete(m.msgsIdToAck, k)
+			break
+		}
+	}
+	if msgId == 0 && len(resp) == 0 {
+		// still queued, sendMessages skips it
+		m.cancelled[resp] = struct{}{}
+	}
+	m.forgetStatus(resp)
+	m.mutex.Unlock()
+
+	if msgId != 0 {
+		// the answer is rpc_answer_unknown, rpc_answer_dropped_running or rpc_answer_dropped,
+		// nothing waits for it
+		m.enqueue(packetToSend{TL_rpc_drop_answer{msgId}, nil})
+	}
+}
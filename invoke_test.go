@@ -0,0 +1,134 @@
+package mtproto
+
+import (
+	"context"
+	"runtime"
+	"testing"
+)
+
+func TestInvokeCancelSent(t *testing.T) {
+	m := newTestMTProto(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := m.Invoke(ctx, TL_help_getConfig{})
+		errs <- err
+	}()
+
+	// sent as the message 100
+	x := <-m.queueSend
+	m.mutex.Lock()
+	m.msgsIdToAck[100] = x
+	m.msgsIdToResp[100] = m.msgsIdToAck[100]
+	m.mutex.Unlock()
+
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("Invoke returned %v", err)
+	}
+	if drop, ok := (<-m.queueSend).msg.(TL_rpc_drop_answer); !ok || drop.req_msg_id != 100 {
+		t.Errorf("Queued %#v instead of rpc_drop_answer", drop)
+	}
+	if len(m.msgsIdToAck) != 0 || len(m.msgsIdToResp) != 0 {
+		t.Error("Cancelled request is still tracked")
+	}
+
+	// the answer to the drop request is ignored
+	m.process(GenerateMessageId()|1, 1, TL_rpc_result{101, TL_rpc_answer_dropped_running{}})
+}
+
+func TestInvokeCancelQueued(t *testing.T) {
+	m := newTestMTProto(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := m.Invoke(ctx, TL_help_getConfig{})
+		errs <- err
+	}()
+	for len(m.queueSend) == 0 {
+		// wait for the request to be queued
+		runtime.Gosched()
+	}
+
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatalf("Invoke returned %v", err)
+	}
+	// m.conn is nil, so this fails if anything is sent
+	if err := m.sendMessages([]packetToSend{<-m.queueSend}); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.cancelled) != 0 || len(m.msgsIdToResp) != 0 {
+		t.Error("Cancelled request is still tracked")
+	}
+}
+
+func TestInvokeCancelPacking(t *testing.T) {
+	m := newTestMTProto(nil)
+	resp := make(chan TL, 1)
+	x := packetToSend{TL_help_getConfig{}, resp}
+
+	// cancelled after sendMessages checked it
+	m.cancel(resp)
+	p, err := m.packMessages([]outMessage{{m.clock.newMsgId(), x.msg.encode(), x}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.data != nil {
+		t.Error("Cancelled request is packed")
+	}
+	if len(m.cancelled) != 0 || len(m.msgsIdToAck) != 0 || len(m.msgsIdToResp) != 0 {
+		t.Error("Cancelled request is still tracked")
+	}
+}
+
+func TestCancelForgetsStatus(t *testing.T) {
+	m := newTestMTProto(nil)
+	req := m.Send(TL_help_getConfig{})
+	x := <-m.queueSend
+	m.mutex.Lock()
+	m.msgsIdToAck[100] = x
+	m.msgsIdToResp[100] = x
+	m.quickAcks[1] = []chan TL{x.resp}
+	m.mutex.Unlock()
+
+	m.cancel(x.resp)
+	if _, ok := (<-m.queueSend).msg.(TL_rpc_drop_answer); !ok {
+		t.Error("No rpc_drop_answer")
+	}
+	if len(m.respToStatus) != 0 || len(m.quickAcks) != 0 {
+		t.Error("Cancelled request is still followed")
+	}
+	if s := <-req.Status; s != StatusQueued {
+		t.Errorf("Got %s", s)
+	}
+}
+
+func TestInvokeErrorAnswer(t *testing.T) {
+	m := newTestMTProto(nil)
+	go func() {
+		x := <-m.queueSend
+		m.mutex.Lock()
+		m.msgsIdToAck[100] = x
+		m.msgsIdToResp[100] = m.msgsIdToAck[100]
+		m.mutex.Unlock()
+		m.handleBadMsg(GenerateMessageId()|1, TL_crc_bad_msg_notification{100, 1, 35})
+	}()
+
+	_, err := m.Invoke(context.Background(), TL_help_getConfig{})
+	if e, ok := err.(BadMsgError); !ok || e.Code != 35 {
+		t.Errorf("Invoke returned %v", err)
+	}
+}
+
+func TestRpcResultHandledObject(t *testing.T) {
+	m := newTestMTProto(nil)
+	resp := make(chan TL, 1)
+	m.msgsIdToResp[100] = packetToSend{TL_help_getConfig{}, resp}
+
+	// process handles msgs_ack itself and gives nothing to answer with
+	m.process(GenerateMessageId()|1, 1, TL_rpc_result{100, TL_msgs_ack{[]int64{1}}})
+	if len(resp) != 0 {
+		t.Errorf("Answered with %#v", <-resp)
+	}
+}
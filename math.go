@@ -2,12 +2,12 @@ package mtproto
 
 import (
 	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
 	"crypto/rsa"
 	sha1lib "crypto/sha1"
 	"errors"
 	"math/big"
-	"math/rand"
-	"time"
 )
 
 const (
@@ -28,15 +28,15 @@ func sha1(data []byte) []byte {
 	return r[:]
 }
 
-func doRSAencrypt(em []byte) []byte {
+func doRSAencrypt(key *rsa.PublicKey, em []byte) []byte {
 	z := make([]byte, 255)
 	copy(z, em)
 
 	c := new(big.Int)
-	c.Exp(new(big.Int).SetBytes(z), big.NewInt(int64(telegramPublicKey.E)), telegramPublicKey.N)
+	c.Exp(new(big.Int).SetBytes(z), big.NewInt(int64(key.E)), key.N)
 
 	res := make([]byte, 256)
-	copy(res, c.Bytes())
+	c.FillBytes(res)
 
 	return res
 }
@@ -49,16 +49,15 @@ func splitPQ(pq *big.Int) (p1, p2 *big.Int) {
 	rndmax := big.NewInt(0).SetBit(big.NewInt(0), 64, 1)
 
 	what := big.NewInt(0).Set(pq)
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
 	g := big.NewInt(0)
 	i := 0
 	for !(g.Cmp(value_1) == 1 && g.Cmp(what) == -1) {
-		q := big.NewInt(0).Rand(rnd, rndmax)
+		q, _ := rand.Int(rand.Reader, rndmax)
 		q = q.And(q, value_15)
 		q = q.Add(q, value_17)
 		q = q.Mod(q, what)
 
-		x := big.NewInt(0).Rand(rnd, rndmax)
+		x, _ := rand.Int(rand.Reader, rndmax)
 		whatnext := big.NewInt(0).Sub(what, value_1)
 		x = x.Mod(x, whatnext)
 		x = x.Add(x, value_1)
@@ -121,10 +120,14 @@ func splitPQ(pq *big.Int) (p1, p2 *big.Int) {
 }
 
 func makeGAB(g int32, g_a, dh_prime *big.Int) (b, g_b, g_ab *big.Int) {
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-	rndmax := big.NewInt(0).SetBit(big.NewInt(0), 2048, 1)
-	b = big.NewInt(0).Rand(rnd, rndmax)
-	g_b = big.NewInt(0).Exp(big.NewInt(int64(g)), b, dh_prime)
+	// a g_b out of the safe range is very unlikely, but must not be sent
+	for {
+		b = new(big.Int).SetBytes(GenerateNonce(256))
+		g_b = big.NewInt(0).Exp(big.NewInt(int64(g)), b, dh_prime)
+		if checkDHValue(g_b, dh_prime) {
+			break
+		}
+	}
 	g_ab = big.NewInt(0).Exp(g_a, b, dh_prime)
 
 	return
@@ -174,6 +177,32 @@ func generateAES(msg_key, auth_key []byte, decode bool) ([]byte, []byte) {
 	return aes_key, aes_iv
 }
 
+// generateAES2 derives the AES key and IV of MTProto 2.0 messages.
+// https://core.telegram.org/mtproto/description#defining-aes-key-and-initialization-vector
+func generateAES2(msg_key, auth_key []byte, decode bool) ([]byte, []byte) {
+	var x int
+	if decode {
+		x = 8
+	} else {
+		x = 0
+	}
+	aes_key := make([]byte, 0, 32)
+	aes_iv := make([]byte, 0, 32)
+
+	sha256_a := sha256Sum(msg_key, auth_key[x:x+36])
+	sha256_b := sha256Sum(auth_key[40+x:40+x+36], msg_key)
+
+	aes_key = append(aes_key, sha256_a[0:8]...)
+	aes_key = append(aes_key, sha256_b[8:8+16]...)
+	aes_key = append(aes_key, sha256_a[24:24+8]...)
+
+	aes_iv = append(aes_iv, sha256_b[0:8]...)
+	aes_iv = append(aes_iv, sha256_a[8:8+16]...)
+	aes_iv = append(aes_iv, sha256_b[24:24+8]...)
+
+	return aes_key, aes_iv
+}
+
 func doAES256IGEencrypt(data, key, iv []byte) ([]byte, error) {
 	block, err := aes.NewCipher(key)
 	if err != nil {
@@ -239,6 +268,18 @@ func doAES256IGEdecrypt(data, key, iv []byte) ([]byte, error) {
 
 }
 
+func newAES256CTR(key, iv []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("AES256CTR: wrong IV size")
+	}
+
+	return cipher.NewCTR(block, iv), nil
+}
+
 func xor(dst, src []byte) {
 	for i := range dst {
 		dst[i] = dst[i] ^ src[i]
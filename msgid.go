@@ -0,0 +1,155 @@
+package mtproto
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// a server message further than this from the estimated server time resynchronizes the clock
+	clockTolerance = 10 * time.Second
+
+	// server messages made out of this window around the server time are ignored
+	msgMaxAge    = 300 * time.Second
+	msgMaxFuture = 30 * time.Second
+
+	// number of server msg_ids remembered to drop replays
+	msgIdWindowSize = 1000
+)
+
+// msgClock makes msg_ids from the estimated server time.
+// https://core.telegram.org/mtproto/description#message-identifier-msg-id
+type msgClock struct {
+	mutex sync.Mutex
+	// server time minus local time
+	offset time.Duration
+	last   int64
+	// the offset is known, either from the server or from the first server message
+	synced bool
+}
+
+// newMsgId returns a msg_id greater than every one returned before.
+func (c *msgClock) newMsgId() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	id := msgIdAt(time.Now().Add(c.offset))
+	if id <= c.last {
+		id = c.last + 4
+	}
+	c.last = id
+	return id
+}
+
+// now returns the estimated server time.
+func (c *msgClock) now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return time.Now().Add(c.offset)
+}
+
+// setServerTime sets the offset from a time reported by the server.
+// msg_ids keep growing even if the offset decreases, see rewind.
+func (c *msgClock) setServerTime(t time.Time) {
+	c.mutex.Lock()
+	c.offset = time.Until(t)
+	c.synced = true
+	c.mutex.Unlock()
+}
+
+// rewind lets msg_ids go back to the server time, after the server rejected
+// a msg_id as too high.
+func (c *msgClock) rewind() {
+	c.mutex.Lock()
+	c.last = 0
+	c.mutex.Unlock()
+}
+
+// observe checks the msg_id of a server message against the estimated server time.
+// The first message sets the clock; later ones out of the window don't move it.
+func (c *msgClock) observe(msgId int64) {
+	d := time.Until(msgIdTime(msgId))
+	c.mutex.Lock()
+	d -= c.offset
+	synced := c.synced
+	c.mutex.Unlock()
+
+	if !synced {
+		c.setServerTime(msgIdTime(msgId))
+		return
+	}
+	if d <= -msgMaxAge || d >= msgMaxFuture {
+		return
+	}
+	if d > clockTolerance || d < -clockTolerance {
+		c.setServerTime(msgIdTime(msgId))
+	}
+}
+
+// inWindow tells whether the server message msgId is recent enough to be processed.
+// Until the clock is synced every authenticated message is, since the local time may be
+// minutes off while the server still accepts our msg_ids. Later bad_msg_notification
+// gets through to fix the clock, see clockFix.
+func (c *msgClock) inWindow(msgId int64) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.synced {
+		return true
+	}
+	d := msgIdTime(msgId).Sub(time.Now().Add(c.offset))
+	return d > -msgMaxAge && d < msgMaxFuture
+}
+
+// clockFix tells whether data corrects the clock, so that it is processed out of the time window too.
+func clockFix(data interface{}) bool {
+	x, ok := data.(TL_crc_bad_msg_notification)
+	return ok && (x.error_code == 16 || x.error_code == 17)
+}
+
+// msgIdWindow keeps the latest server msg_ids to drop duplicates.
+// Only the routine reading the connection uses it.
+type msgIdWindow struct {
+	// sorted ascending
+	ids []int64
+}
+
+// has tells whether msgId is in the window.
+func (w *msgIdWindow) has(msgId int64) bool {
+	i := sort.Search(len(w.ids), func(i int) bool { return w.ids[i] >= msgId })
+	return i < len(w.ids) && w.ids[i] == msgId
+}
+
+// add records msgId. It returns false if msgId was seen already, or if it is older
+// than every msg_id of the full window, so that it can't be told apart from a replay.
+func (w *msgIdWindow) add(msgId int64) bool {
+	i := sort.Search(len(w.ids), func(i int) bool { return w.ids[i] >= msgId })
+	if i < len(w.ids) && w.ids[i] == msgId {
+		return false
+	}
+	if len(w.ids) < msgIdWindowSize {
+		w.ids = append(w.ids, 0)
+		copy(w.ids[i+1:], w.ids[i:])
+		w.ids[i] = msgId
+		return true
+	}
+	if i == 0 {
+		return false
+	}
+	// forget the oldest one
+	copy(w.ids[:i-1], w.ids[1:i])
+	w.ids[i-1] = msgId
+	return true
+}
+
+func msgIdAt(t time.Time) int64 {
+	const nano = 1000 * 1000 * 1000
+	unixnano := t.UnixNano()
+
+	return ((unixnano / nano) << 32) | ((unixnano % nano) & -4)
+}
+
+// msgIdTime returns the time a msg_id was made at, with second precision.
+func msgIdTime(msgId int64) time.Time {
+	return time.Unix(msgId>>32, 0)
+}
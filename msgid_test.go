@@ -0,0 +1,98 @@
+package mtproto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMsgClockMonotonic(t *testing.T) {
+	var c msgClock
+	last := int64(0)
+	for i := 0; i < 10000; i++ {
+		id := c.newMsgId()
+		if id <= last || id&3 != 0 {
+			t.Fatalf("msg_id %d after %d", id, last)
+		}
+		last = id
+	}
+}
+
+func TestMsgClockServerTime(t *testing.T) {
+	var c msgClock
+	ahead := time.Now().Add(5 * time.Minute)
+	c.setServerTime(ahead)
+	if d := msgIdTime(c.newMsgId()).Sub(ahead); d < -time.Second || d > time.Second {
+		t.Errorf("msg_id is %s off the server time", d)
+	}
+
+	// a late message doesn't move the clock
+	c.observe(msgIdAt(ahead.Add(-5*time.Second)) | 1)
+	if d := msgIdTime(c.newMsgId()).Sub(ahead); d < -time.Second || d > time.Second {
+		t.Errorf("msg_id is %s off the server time", d)
+	}
+
+	// a server message with a time further from ours does
+	later := ahead.Add(20 * time.Second)
+	c.observe(msgIdAt(later) | 1)
+	if d := msgIdTime(c.newMsgId()).Sub(later); d < -time.Second || d > time.Second {
+		t.Errorf("msg_id is %s off the server time", d)
+	}
+
+	// unless it is out of the window
+	c.observe(msgIdAt(later.Add(-time.Hour)) | 1)
+	if d := c.now().Sub(later); d < -time.Second || d > time.Second {
+		t.Errorf("Clock is %s off the server time", d)
+	}
+}
+
+func TestMsgClockOffsetDecreases(t *testing.T) {
+	var c msgClock
+	c.setServerTime(time.Now().Add(time.Minute))
+	last := c.newMsgId()
+
+	c.setServerTime(time.Now())
+	for i := 0; i < 100; i++ {
+		id := c.newMsgId()
+		if id <= last {
+			t.Fatalf("msg_id %d after %d", id, last)
+		}
+		last = id
+	}
+
+	// unless the server said the msg_ids are too high
+	c.rewind()
+	if id := c.newMsgId(); id >= last {
+		t.Errorf("msg_id %d is not back to the server time", id)
+	}
+}
+
+func TestBadMsgNotificationSyncsTime(t *testing.T) {
+	m := newTestMTProto(nil)
+	server := time.Now().Add(-3 * time.Minute)
+	m.process(msgIdAt(server)|1, 0, TL_crc_bad_msg_notification{m.clock.newMsgId(), 1, 17})
+	if d := msgIdTime(m.clock.newMsgId()).Sub(server); d < -time.Second || d > time.Second {
+		t.Errorf("msg_id is %s off the server time", d)
+	}
+}
+
+func TestMsgIdWindow(t *testing.T) {
+	var w msgIdWindow
+	for i := int64(1); i <= msgIdWindowSize; i++ {
+		if !w.add(i * 4) {
+			t.Fatalf("msg_id %d rejected", i*4)
+		}
+	}
+	if w.add(40) {
+		t.Error("Duplicate accepted")
+	}
+	// the window is full, so the oldest one is forgotten
+	if !w.add(42) || w.ids[0] != 8 {
+		t.Errorf("Window starts at %d", w.ids[0])
+	}
+	if w.add(6) {
+		t.Error("msg_id older than the window accepted")
+	}
+	if !w.add(msgIdWindowSize*4+4) || len(w.ids) != msgIdWindowSize {
+		t.Errorf("Window of %d msg_ids", len(w.ids))
+	}
+}
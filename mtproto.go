@@ -1,10 +1,9 @@
 package mtproto
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"math/rand"
-	"net"
 	"os"
 	"runtime"
 	"sync"
@@ -18,28 +17,187 @@ const (
 
 type MTProto struct {
 	addr      string
-	conn      *net.TCPConn
+	dcId      int32
+	conn      packetConn
 	f         *os.File
 	queueSend chan packetToSend
-	stopSend  chan struct{}
-	stopRead  chan struct{}
-	stopPing  chan struct{}
-	allDone   chan struct{}
+	stop      chan struct{}
+	routines  sync.WaitGroup
 
 	authKey     []byte
 	authKeyHash []byte
 	serverSalt  []byte
 	encrypted   bool
 	sessionId   int64
-
+	// a key exchange is running, so unencrypted messages are expected
+	exchanging bool
+
+	// sessions to destroy, and the id of the server instance, see session.go
+	staleSessions  []int64
+	serverUniqueId int64
+	onUpdatesGap   func()
+	onConnError    func(error)
+
+	// salts from get_future_salts, see salts.go
+	futureSalts    []futureSalt
+	saltsRequested time.Time
+
+	// with PFS messages are encrypted with a temporary key, see pfs.go
+	tempKeyTTL      time.Duration
+	tempAuthKey     []byte
+	tempAuthKeyHash []byte
+	tempKeyExpires  time.Time
+
+	clock        msgClock
+	received     msgIdWindow
 	mutex        *sync.Mutex
+	reconnecting bool
 	lastSeqNo    int32
 	msgsIdToAck  map[int64]packetToSend
-	msgsIdToResp map[int64]chan TL
+	msgsIdToResp map[int64]packetToSend
+	respToStatus map[chan TL]chan DeliveryStatus
+	quickAcks    map[uint32][]chan TL
+	containers   map[int64][]int64
+	stateReqs    map[int64][]int64
+	cancelled    map[chan TL]struct{}
 	seqNo        int32
 	msgId        int64
 
-	dclist map[int32]string
+	dcs           *dcTable
+	rsaKeys       rsaKeys
+	mtproto2      bool
+	gzipThreshold int
+
+	newTransport func() Transport
+	proxy        *mtproxy
+	dial         DialContextFunc
+	httpScheme   string
+	wsScheme     string
+}
+
+// Option configures an MTProto instance created by NewMTProto.
+type Option func(*MTProto) error
+
+// WithTransport selects the framing used on the wire.
+// newTransport is called for every new connection; the default is NewAbridgedTransport.
+func WithTransport(newTransport func() Transport) Option {
+	return func(m *MTProto) error {
+		m.newTransport = newTransport
+		return nil
+	}
+}
+
+// WithDialer replaces the function used to open connections, e.g. with
+// SOCKS5Dialer or HTTPConnectDialer.
+func WithDialer(dial DialContextFunc) Option {
+	return func(m *MTProto) error {
+		m.dial = dial
+		return nil
+	}
+}
+
+// WithHTTPTransport sends packets as HTTP POST requests to /api on the DC address
+// instead of keeping a TCP connection open. Server messages are long-polled with http_wait.
+func WithHTTPTransport(useTLS bool) Option {
+	return func(m *MTProto) error {
+		m.httpScheme = "http"
+		if useTLS {
+			m.httpScheme = "https"
+		}
+		return nil
+	}
+}
+
+// WithWebSocket carries the obfuscated transport over WebSocket binary messages
+// to /apiws, as the official web clients do: on the DC address, or with TLS
+// on the {name}.web.telegram.org host of the DC, which the certificate is issued for.
+func WithWebSocket(useTLS bool) Option {
+	return func(m *MTProto) error {
+		m.wsScheme = "ws"
+		if useTLS {
+			m.wsScheme = "wss"
+		}
+		return nil
+	}
+}
+
+// WithIPv6 makes IPv6 addresses from dc_options preferred over IPv4 ones.
+func WithIPv6(prefer bool) Option {
+	return func(m *MTProto) error {
+		m.dcs.preferIPv6 = prefer
+		return nil
+	}
+}
+
+// WithMTProto2 encrypts messages with MTProto 2.0: SHA-256 based msg_key and
+// AES key derivation and 12-1024 bytes of random padding. The default is the old scheme.
+func WithMTProto2(enable bool) Option {
+	return func(m *MTProto) error {
+		m.mtproto2 = enable
+		return nil
+	}
+}
+
+// WithGzip sets the size above which outgoing requests are compressed with gzip_packed,
+// 1024 bytes by default. Zero disables the compression.
+func WithGzip(threshold int) Option {
+	return func(m *MTProto) error {
+		m.gzipThreshold = threshold
+		return nil
+	}
+}
+
+// WithUpdatesGap sets a function called when the server may have lost updates meant
+// for this client, e.g. after it was restarted. It should fetch them with updates.getDifference.
+func WithUpdatesGap(f func()) Option {
+	return func(m *MTProto) error {
+		m.onUpdatesGap = f
+		return nil
+	}
+}
+
+// WithConnectionErrors sets a function called with the errors which break the connection
+// and those of the reconnect attempts. It is called from the connection routines,
+// so it must not block.
+func WithConnectionErrors(f func(error)) Option {
+	return func(m *MTProto) error {
+		m.onConnError = f
+		return nil
+	}
+}
+
+// WithPFS enables perfect forward secrecy: messages are encrypted with a temporary
+// auth key bound to the permanent one, and a new temporary key is made every ttl.
+func WithPFS(ttl time.Duration) Option {
+	return func(m *MTProto) error {
+		if ttl < 2*tempKeyRenewBefore {
+			return fmt.Errorf("PFS: temporary key lifetime %s is too short", ttl)
+		}
+		m.tempKeyTTL = ttl
+		return nil
+	}
+}
+
+// WithPublicKeys adds the server RSA keys found in pemData to the built-in one,
+// e.g. for test DCs. Keys with rsaPad are used with the RSA_PAD scheme.
+func WithPublicKeys(pemData []byte, rsaPad bool) Option {
+	return func(m *MTProto) error {
+		return m.rsaKeys.addPEM(pemData, rsaPad)
+	}
+}
+
+// WithMTProxy connects through an MTProxy server instead of dialing the DC directly.
+// The secret is given in hex or base64 form; "dd" secrets enable the padded
+// intermediate transport and "ee" secrets the fake-TLS wrapping.
+func WithMTProxy(addr, secret string) Option {
+	return func(m *MTProto) error {
+		proxy, err := parseProxySecret(addr, secret)
+		if err != nil {
+			return err
+		}
+		m.proxy = proxy
+		return nil
+	}
 }
 
 type packetToSend struct {
@@ -47,9 +205,20 @@ type packetToSend struct {
 	resp chan TL
 }
 
-func NewMTProto(authkeyfile string) (*MTProto, error) {
+func NewMTProto(authkeyfile string, options ...Option) (*MTProto, error) {
 	var err error
 	m := new(MTProto)
+	m.newTransport = NewAbridgedTransport
+	m.dial = defaultDialer(nil)
+	m.dcs = newDcTable()
+	m.rsaKeys = newRSAKeys()
+	m.gzipThreshold = defaultGzipThreshold
+	for _, option := range options {
+		err = option(m)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	m.f, err = os.OpenFile(authkeyfile, os.O_RDWR|os.O_CREATE, 0600)
 	if err != nil {
@@ -61,58 +230,55 @@ func NewMTProto(authkeyfile string) (*MTProto, error) {
 		m.encrypted = true
 	} else {
 		m.addr = "149.154.167.50:443"
+		m.dcId = 2
 		m.encrypted = false
 	}
-	rand.Seed(time.Now().UnixNano())
-	m.sessionId = rand.Int63()
+	m.sessionId = randomLong()
+	m.initQueues()
 
 	return m, nil
 }
 
-func (m *MTProto) Connect() error {
-	var err error
-	var tcpAddr *net.TCPAddr
+// initQueues makes the send queue and the maps of sent messages.
+// They outlive connections, see reconnect.go.
+func (m *MTProto) initQueues() {
+	m.queueSend = make(chan packetToSend, 64)
+	m.msgsIdToAck = make(map[int64]packetToSend)
+	m.msgsIdToResp = make(map[int64]packetToSend)
+	m.respToStatus = make(map[chan TL]chan DeliveryStatus)
+	m.quickAcks = make(map[uint32][]chan TL)
+	m.containers = make(map[int64][]int64)
+	m.stateReqs = make(map[int64][]int64)
+	m.cancelled = make(map[chan TL]struct{})
+	m.mutex = &sync.Mutex{}
+}
 
-	// connect
-	tcpAddr, err = net.ResolveTCPAddr("tcp", m.addr)
-	if err != nil {
-		return err
-	}
-	m.conn, err = net.DialTCP("tcp", nil, tcpAddr)
-	if err != nil {
-		return err
-	}
-	_, err = m.conn.Write([]byte{0xef})
+func (m *MTProto) Connect() error {
+	err := m.connect()
 	if err != nil {
 		return err
 	}
+	m.startRoutines()
 
-	// get new authKey if need
-	if !m.encrypted {
-		err = m.makeAuthKey()
-		if err != nil {
-			return err
-		}
+	// (help_getConfig)
+	resp := make(chan TL, 1)
+	m.queueSend <- m.initConnection(resp)
+	x := <-resp
+	switch x.(type) {
+	case TL_config:
+		m.dcs.reset(x.(TL_config).dc_options)
+	default:
+		return fmt.Errorf("Got: %T", x)
 	}
+	m.destroyStaleSessions()
 
-	// start goroutines
-	m.queueSend = make(chan packetToSend, 64)
-	m.stopSend = make(chan struct{}, 1)
-	m.stopRead = make(chan struct{}, 1)
-	m.stopPing = make(chan struct{}, 1)
-	m.allDone = make(chan struct{}, 3)
-	m.msgsIdToAck = make(map[int64]packetToSend)
-	m.msgsIdToResp = make(map[int64]chan TL)
-	m.mutex = &sync.Mutex{}
-	go m.sendRoutine()
-	go m.readRoutine()
-
-	var resp chan TL
-	var x TL
+	return nil
+}
 
-	// (help_getConfig)
-	resp = make(chan TL, 1)
-	m.queueSend <- packetToSend{
+// initConnection makes the help.getConfig request wrapped in initConnection,
+// which the server needs as the first request with every new auth key.
+func (m *MTProto) initConnection(resp chan TL) packetToSend {
+	return packetToSend{
 		TL_invokeWithLayer{
 			layer,
 			TL_initConnection{
@@ -126,57 +292,61 @@ func (m *MTProto) Connect() error {
 		},
 		resp,
 	}
-	x = <-resp
-	switch x.(type) {
-	case TL_config:
-		m.dclist = make(map[int32]string, 5)
-		for _, v := range x.(TL_config).dc_options {
-			// v := v.(TL_dcOption)
-			m.dclist[v.id] = fmt.Sprintf("%s:%d", v.ip_address, v.port)
-		}
-	default:
-		return fmt.Errorf("Got: %T", x)
-	}
-
-	// start keepalive pinging
-	go m.pingRoutine()
+}
 
-	return nil
+// applyConfig updates the DC list with the config answered on resp.
+func (m *MTProto) applyConfig(resp chan TL) {
+	if x, ok := (<-resp).(TL_config); ok {
+		m.dcs.reset(x.dc_options)
+	}
 }
 
-func (m *MTProto) reconnect(newaddr string) error {
+// connect opens a connection and creates the auth key if there is none yet.
+func (m *MTProto) connect() error {
 	var err error
 
-	// stop ping routine
-	m.stopPing <- struct{}{}
-	close(m.stopPing)
+	m.conn, err = m.dialConn()
+	if err != nil {
+		return err
+	}
 
-	// stop send routine
-	m.stopSend <- struct{}{}
-	close(m.stopSend)
+	// get new authKey if need
+	if !m.encrypted {
+		err = m.makeAuthKey()
+		if err != nil {
+			_ = m.conn.Close()
+			return err
+		}
+	}
 
-	// stop read routine
-	m.stopRead <- struct{}{}
-	close(m.stopRead)
+	if m.needTempKey() {
+		err = m.makeTempAuthKey()
+		if err != nil {
+			_ = m.conn.Close()
+			return err
+		}
+	}
 
-	<-m.allDone
-	<-m.allDone
-	<-m.allDone
+	return nil
+}
 
-	// close send queue
-	close(m.queueSend)
+// reconnect moves the session to another DC.
+func (m *MTProto) reconnect(newaddr string) error {
+	m.stopRoutines()
 
-	// close connection
-	err = m.conn.Close()
+	// renew connection
+	m.encrypted = false
+	m.tempAuthKey = nil
+	// the sessions belong to the key on the old DC
+	m.staleSessions = nil
+	m.addr = newaddr
+	err := m.Connect()
 	if err != nil {
 		return err
 	}
+	m.resendPending()
 
-	// renew connection
-	m.encrypted = false
-	m.addr = newaddr
-	err = m.Connect()
-	return err
+	return nil
 }
 
 func (m *MTProto) Auth(phonenumber string) error {
@@ -184,9 +354,10 @@ func (m *MTProto) Auth(phonenumber string) error {
 
 	flag := true
 	for flag {
-		resp := make(chan TL, 1)
-		m.queueSend <- packetToSend{TL_auth_sendCode{0, false, phonenumber, false, appId, appHash}, resp}
-		x := <-resp
+		x, err := m.Invoke(context.Background(), TL_auth_sendCode{0, false, phonenumber, false, appId, appHash})
+		if err != nil {
+			return err
+		}
 		switch x.(type) {
 		case TL_auth_sentCode:
 			authSentCode = x.(TL_auth_sentCode)
@@ -205,11 +376,12 @@ func (m *MTProto) Auth(phonenumber string) error {
 				}
 			}
 
-			newDcAddr, ok := m.dclist[newDc]
-			if !ok {
+			newDcAddrs := m.DCAddresses(newDc, false)
+			if len(newDcAddrs) == 0 {
 				return fmt.Errorf("Wrong DC index: %d", newDc)
 			}
-			err := m.reconnect(newDcAddr)
+			m.dcId = newDc
+			err := m.reconnect(newDcAddrs[0])
 			if err != nil {
 				return err
 			}
@@ -225,12 +397,13 @@ func (m *MTProto) Auth(phonenumber string) error {
 	fmt.Scanf("%d", &code)
 
 	if authSentCode.phone_registered {
-		resp := make(chan TL, 1)
-		m.queueSend <- packetToSend{
+		x, err := m.Invoke(
+			context.Background(),
 			TL_auth_signIn{phonenumber, authSentCode.phone_code_hash, fmt.Sprintf("%d", code)},
-			resp,
+		)
+		if err != nil {
+			return err
 		}
-		x := <-resp
 		auth, ok := x.(TL_auth_authorization)
 		if !ok {
 			return fmt.Errorf("RPC: %#v", x)
@@ -247,9 +420,10 @@ func (m *MTProto) Auth(phonenumber string) error {
 }
 
 func (m *MTProto) GetContacts() error {
-	resp := make(chan TL, 1)
-	m.queueSend <- packetToSend{TL_contacts_getContacts{""}, resp}
-	x := <-resp
+	x, err := m.Invoke(context.Background(), TL_contacts_getContacts{""})
+	if err != nil {
+		return err
+	}
 	list, ok := x.(TL_contacts_contacts)
 	if !ok {
 		return fmt.Errorf("RPC: %#v", x)
@@ -280,16 +454,14 @@ func (m *MTProto) GetContacts() error {
 }
 
 func (m *MTProto) SendMessage(user_id int32, msg string) error {
-	resp := make(chan TL, 1)
-	m.queueSend <- packetToSend{
-		TL_messages_sendMessage{
-			TL_inputPeerContact{user_id},
-			msg,
-			rand.Int63(),
-		},
-		resp,
+	x, err := m.Invoke(context.Background(), TL_messages_sendMessage{
+		TL_inputPeerContact{user_id},
+		msg,
+		randomLong(),
+	})
+	if err != nil {
+		return err
 	}
-	x := <-resp
 	_, ok := x.(TL_messages_sentMessage)
 	if !ok {
 		return fmt.Errorf("RPC: %#v", x)
@@ -298,39 +470,79 @@ func (m *MTProto) SendMessage(user_id int32, msg string) error {
 	return nil
 }
 
-func (m *MTProto) pingRoutine() {
+func (m *MTProto) pingRoutine(stop <-chan struct{}) {
+	defer m.routines.Done()
+
+	// over HTTP the server can only answer requests, so keep one long poll open
+	var httpIdle chan struct{}
+	if c, ok := m.conn.(*httpConn); ok {
+		httpIdle = c.idle
+	}
+
+	// the temporary key is replaced on the next connection
+	var renew <-chan time.Time
+	if m.tempAuthKey != nil {
+		timer := time.NewTimer(time.Until(m.tempKeyExpires) - tempKeyRenewBefore)
+		defer timer.Stop()
+		renew = timer.C
+	}
+
 	for {
 		select {
-		case <-m.stopPing:
-			m.allDone <- struct{}{}
+		case <-stop:
+			return
+		case <-renew:
+			m.connectionLost(stop, errors.New("PFS: temporary key expires"))
 			return
 		case <-time.After(60 * time.Second):
-			m.queueSend <- packetToSend{TL_ping{0xCADACADA}, nil}
+			m.enqueue(packetToSend{TL_ping{0xCADACADA}, nil})
+			if m.needFutureSalts() {
+				m.enqueue(packetToSend{TL_get_future_salts{futureSaltsNum}, nil})
+			}
+		case <-httpIdle:
+			m.enqueue(packetToSend{TL_http_wait{0, 0, httpWaitMax}, nil})
 		}
 	}
 }
 
-func (m *MTProto) sendRoutine() {
-	for x := range m.queueSend {
-		err := m.sendPacket(x.msg, x.resp)
-		if err != nil {
-			fmt.Println("SendRoutine:", err)
-			os.Exit(2)
+func (m *MTProto) sendRoutine(stop <-chan struct{}) {
+	defer m.routines.Done()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case x := <-m.queueSend:
+			// whatever else is queued already goes out in the same container
+			batch := []packetToSend{x}
+		drain:
+			for len(batch) < containerMaxMessages {
+				select {
+				case y := <-m.queueSend:
+					batch = append(batch, y)
+				default:
+					break drain
+				}
+			}
+			err := m.sendMessages(batch)
+			if err != nil {
+				m.connectionLost(stop, err)
+				return
+			}
 		}
 	}
-
-	m.allDone <- struct{}{}
 }
 
-func (m *MTProto) readRoutine() {
+func (m *MTProto) readRoutine(stop <-chan struct{}) {
+	defer m.routines.Done()
+
 	for {
-		data, err := m.read(m.stopRead)
+		data, err := m.read(stop)
 		if err != nil {
-			fmt.Println("ReadRoutine:", err)
-			os.Exit(2)
+			m.connectionLost(stop, err)
+			return
 		}
 		if data == nil {
-			m.allDone <- struct{}{}
 			return
 		}
 
@@ -344,36 +556,79 @@ func (m *MTProto) process(msgId int64, seqNo int32, data interface{}) interface{
 	case TL_msg_container:
 		data := data.(TL_msg_container).items
 		for _, v := range data {
+			if !m.received.add(v.msg_id) {
+				// resent by the server because the ack got lost
+				if (v.seq_no & 1) == 1 {
+					m.enqueue(packetToSend{TL_msgs_ack{[]int64{v.msg_id}}, nil})
+				}
+				continue
+			}
 			m.process(v.msg_id, v.seq_no, v.data)
 		}
 
 	case TL_bad_server_salt:
 		data := data.(TL_bad_server_salt)
-		m.serverSalt = data.new_server_salt
-		_ = m.saveData()
 		m.mutex.Lock()
-		for k, v := range m.msgsIdToAck {
-			delete(m.msgsIdToAck, k)
-			m.queueSend <- v
-		}
+		m.serverSalt = data.new_server_salt
+		// the future salts didn't help, ask for them again
+		m.futureSalts = nil
+		m.saltsRequested = time.Time{}
 		m.mutex.Unlock()
+		_ = m.saveData()
+		m.resend(data.bad_msg_id)
+
+	case TL_crc_bad_msg_notification:
+		m.handleBadMsg(msgId, data.(TL_crc_bad_msg_notification))
 
 	case TL_new_session_created:
-		data := data.(TL_new_session_created)
-		m.serverSalt = data.server_salt
-		_ = m.saveData()
+		m.sessionCreated(data.(TL_new_session_created))
+
+	case TL_destroy_session_ok, TL_destroy_session_none:
+		// (ignore)
 
 	case TL_ping:
 		data := data.(TL_ping)
-		m.queueSend <- packetToSend{TL_pong{msgId, data.ping_id}, nil}
+		m.enqueue(packetToSend{TL_pong{msgId, data.ping_id}, nil})
 
 	case TL_pong:
 		// (ignore)
 
+	case TL_msgs_state_info:
+		data := data.(TL_msgs_state_info)
+		m.mutex.Lock()
+		ids := m.stateReqs[data.req_msg_id]
+		delete(m.stateReqs, data.req_msg_id)
+		m.mutex.Unlock()
+		m.applyStates(ids, data.info)
+
+	case TL_msgs_all_info:
+		data := data.(TL_msgs_all_info)
+		m.applyStates(data.msg_ids, data.info)
+
+	case TL_msg_detailed_info:
+		data := data.(TL_msg_detailed_info)
+		m.detailedInfo(data.msg_id, data.answer_msg_id)
+
+	case TL_msg_new_detailed_info:
+		data := data.(TL_msg_new_detailed_info)
+		m.newDetailedInfo(data.answer_msg_id)
+
+	case TL_future_salts:
+		data := data.(TL_future_salts)
+		m.setFutureSalts(data)
+		m.answer(data.req_msg_id, data)
+
+	case TL_updates, TL_updatesCombined, TL_updateShort:
+		m.handleUpdates(data.(TL))
+		return data
+
 	case TL_msgs_ack:
 		data := data.(TL_msgs_ack)
 		m.mutex.Lock()
 		for _, v := range data.msgIds {
+			if x, ok := m.msgsIdToAck[v]; ok {
+				m.setStatus(x.resp, StatusAcked)
+			}
 			delete(m.msgsIdToAck, v)
 		}
 		m.mutex.Unlock()
@@ -381,15 +636,10 @@ func (m *MTProto) process(msgId int64, seqNo int32, data interface{}) interface{
 	case TL_rpc_result:
 		data := data.(TL_rpc_result)
 		x := m.process(msgId, seqNo, data.obj)
-		m.mutex.Lock()
-		v, ok := m.msgsIdToResp[data.req_msg_id]
-		if ok {
-			v <- x.(TL)
-			close(v)
-			delete(m.msgsIdToResp, data.req_msg_id)
+		// objects handled by process itself, like future_salts, give nil
+		if x, ok := x.(TL); ok {
+			m.answer(data.req_msg_id, x)
 		}
-		delete(m.msgsIdToAck, data.req_msg_id)
-		m.mutex.Unlock()
 
 	default:
 		return data
@@ -397,12 +647,26 @@ func (m *MTProto) process(msgId int64, seqNo int32, data interface{}) interface{
 	}
 
 	if (seqNo & 1) == 1 {
-		m.queueSend <- packetToSend{TL_msgs_ack{[]int64{msgId}}, nil}
+		m.enqueue(packetToSend{TL_msgs_ack{[]int64{msgId}}, nil})
 	}
 
 	return nil
 }
 
+// answer delivers x to the caller waiting for the request msgId.
+func (m *MTProto) answer(msgId int64, x TL) {
+	m.mutex.Lock()
+	v, ok := m.msgsIdToResp[msgId]
+	if ok {
+		m.setStatus(v.resp, StatusAnswered)
+		v.resp <- x
+		close(v.resp)
+		delete(m.msgsIdToResp, msgId)
+	}
+	delete(m.msgsIdToAck, msgId)
+	m.mutex.Unlock()
+}
+
 func (m *MTProto) saveData() (err error) {
 	m.encrypted = true
 
@@ -411,6 +675,13 @@ func (m *MTProto) saveData() (err error) {
 	b.StringBytes(m.authKeyHash)
 	b.StringBytes(m.serverSalt)
 	b.String(m.addr)
+	b.Int(m.dcId)
+	if m.tempAuthKey == nil {
+		// destroyed on the next start
+		b.Long(m.sessionId)
+	} else {
+		b.Long(0)
+	}
 
 	err = m.f.Truncate(0)
 	if err != nil {
@@ -425,6 +696,21 @@ func (m *MTProto) saveData() (err error) {
 	return nil
 }
 
+// dropAuthKey forgets the auth key, also in the file, and starts a new session.
+func (m *MTProto) dropAuthKey() {
+	m.encrypted = false
+	m.authKey = nil
+	m.authKeyHash = nil
+	m.serverSalt = nil
+	m.futureSalts = nil
+	m.tempAuthKey = nil
+	m.tempAuthKeyHash = nil
+	m.sessionId = randomLong()
+	m.lastSeqNo = 0
+	m.staleSessions = nil
+	_ = m.f.Truncate(0)
+}
+
 func (m *MTProto) readData() (err error) {
 	b := make([]byte, 1024*4)
 	n, err := m.f.ReadAt(b, 0)
@@ -437,6 +723,14 @@ func (m *MTProto) readData() (err error) {
 	m.authKeyHash = d.StringBytes()
 	m.serverSalt = d.StringBytes()
 	m.addr = d.String()
+	m.dcId = d.Int()
+	if m.dcId == 0 {
+		// saved before the DC id was stored
+		m.dcId = 2
+	}
+	if id := d.Long(); id != 0 {
+		m.staleSessions = append(m.staleSessions, id)
+	}
 
 	if d.err != nil {
 		return d.err
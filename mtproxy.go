@@ -0,0 +1,252 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	proxySecretPlain   = 0x00
+	proxySecretPadded  = 0xdd
+	proxySecretFakeTLS = 0xee
+
+	// tls record types
+	tlsHandshake        = 0x16
+	tlsChangeCipherSpec = 0x14
+	tlsApplicationData  = 0x17
+
+	tlsMaxRecordSize = 16384
+)
+
+// mtproxy holds the address and the secret of an MTProxy server.
+type mtproxy struct {
+	addr   string
+	kind   byte
+	key    []byte
+	domain string
+}
+
+// parseProxySecret accepts the secret in hex or base64 form, as it appears in proxy links.
+func parseProxySecret(addr, secret string) (*mtproxy, error) {
+	b, err := hex.DecodeString(secret)
+	if err != nil {
+		b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(secret, "="))
+		if err != nil {
+			return nil, errors.New("MTProxy: secret is neither hex nor base64")
+		}
+	}
+
+	p := &mtproxy{addr: addr}
+	switch {
+	case len(b) == 16:
+		p.kind, p.key = proxySecretPlain, b
+	case len(b) == 17 && b[0] == proxySecretPadded:
+		p.kind, p.key = proxySecretPadded, b[1:]
+	case len(b) > 17 && b[0] == proxySecretFakeTLS:
+		p.kind, p.key, p.domain = proxySecretFakeTLS, b[1:17], string(b[17:])
+	default:
+		return nil, fmt.Errorf("MTProxy: unsupported secret (%d bytes)", len(b))
+	}
+
+	return p, nil
+}
+
+// transport wraps the framing codec into the obfuscated transport keyed with the proxy secret.
+func (p *mtproxy) transport(inner Transport, dc int32) Transport {
+	if t, ok := inner.(*obfuscatedTransport); ok {
+		inner = t.inner
+	}
+	if p.kind != proxySecretPlain {
+		inner = NewPaddedIntermediateTransport()
+	}
+
+	return &obfuscatedTransport{inner: inner, secret: p.key, dc: int16(dc)}
+}
+
+// wrap prepares a fresh connection to the proxy for the obfuscated header.
+func (p *mtproxy) wrap(conn net.Conn) (net.Conn, error) {
+	if p.kind != proxySecretFakeTLS {
+		return conn, nil
+	}
+
+	c := &fakeTLSConn{Conn: conn}
+	err := c.handshake(p.key, p.domain)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// fakeTLSConn hides the obfuscated stream inside TLS 1.3 application data records.
+type fakeTLSConn struct {
+	net.Conn
+	sentCCS bool
+	pending []byte
+}
+
+func (c *fakeTLSConn) handshake(key []byte, domain string) error {
+	hello := makeClientHello(domain)
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(hello)
+	digest := mac.Sum(nil)
+	t := binary.LittleEndian.Uint32(digest[28:]) ^ uint32(time.Now().Unix())
+	binary.LittleEndian.PutUint32(digest[28:], t)
+	copy(hello[11:], digest)
+
+	_, err := c.Conn.Write(hello)
+	if err != nil {
+		return err
+	}
+
+	// ServerHello, ChangeCipherSpec and the first application data record
+	var answer []byte
+	for _, recordType := range []byte{tlsHandshake, tlsChangeCipherSpec, tlsApplicationData} {
+		header := make([]byte, 5)
+		_, err = io.ReadFull(c.Conn, header)
+		if err != nil {
+			return err
+		}
+		if header[0] != recordType || header[1] != 0x03 || header[2] != 0x03 {
+			return fmt.Errorf("MTProxy: unexpected TLS record %x", header)
+		}
+		body := make([]byte, binary.BigEndian.Uint16(header[3:]))
+		_, err = io.ReadFull(c.Conn, body)
+		if err != nil {
+			return err
+		}
+		answer = append(answer, header...)
+		answer = append(answer, body...)
+	}
+	if len(answer) < 11+32 {
+		return errors.New("MTProxy: ServerHello too short")
+	}
+
+	serverDigest := make([]byte, 32)
+	copy(serverDigest, answer[11:])
+	copy(answer[11:], make([]byte, 32))
+	mac.Reset()
+	_, _ = mac.Write(digest)
+	_, _ = mac.Write(answer)
+	if !hmac.Equal(mac.Sum(nil), serverDigest) {
+		return errors.New("MTProxy: wrong ServerHello digest")
+	}
+
+	return nil
+}
+
+func (c *fakeTLSConn) Write(b []byte) (int, error) {
+	x := make([]byte, 0, len(b)+11+5*(len(b)/tlsMaxRecordSize))
+	if !c.sentCCS {
+		x = append(x, tlsChangeCipherSpec, 0x03, 0x03, 0x00, 0x01, 0x01)
+	}
+	for left := b; len(left) > 0; {
+		size := len(left)
+		if size > tlsMaxRecordSize {
+			size = tlsMaxRecordSize
+		}
+		x = append(x, tlsApplicationData, 0x03, 0x03, byte(size>>8), byte(size))
+		x = append(x, left[:size]...)
+		left = left[size:]
+	}
+
+	_, err := c.Conn.Write(x)
+	if err != nil {
+		return 0, err
+	}
+	c.sentCCS = true
+
+	return len(b), nil
+}
+
+func (c *fakeTLSConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		header := make([]byte, 5)
+		_, err := io.ReadFull(c.Conn, header)
+		if err != nil {
+			return 0, err
+		}
+		body := make([]byte, binary.BigEndian.Uint16(header[3:]))
+		_, err = io.ReadFull(c.Conn, body)
+		if err != nil {
+			return 0, err
+		}
+
+		switch header[0] {
+		case tlsApplicationData:
+			c.pending = body
+		case tlsChangeCipherSpec:
+			// (ignore)
+		default:
+			return 0, fmt.Errorf("MTProxy: unexpected TLS record type 0x%02x", header[0])
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// makeClientHello returns a TLS 1.3 ClientHello record with a zeroed random
+// field, resembling the one sent by browsers.
+func makeClientHello(domain string) []byte {
+	ext := new(bytes.Buffer)
+	extension := func(id uint16, data []byte) {
+		_ = binary.Write(ext, binary.BigEndian, id)
+		_ = binary.Write(ext, binary.BigEndian, uint16(len(data)))
+		ext.Write(data)
+	}
+
+	sni := make([]byte, 5, 5+len(domain))
+	binary.BigEndian.PutUint16(sni, uint16(len(domain)+3))
+	binary.BigEndian.PutUint16(sni[3:], uint16(len(domain)))
+	sni = append(sni, domain...)
+
+	extension(0x0000, sni)                                                    // server_name
+	extension(0x0017, nil)                                                    // extended_master_secret
+	extension(0xff01, []byte{0x00})                                           // renegotiation_info
+	extension(0x000a, []byte{0x00, 0x06, 0x00, 0x1d, 0x00, 0x17, 0x00, 0x18}) // supported_groups
+	extension(0x000b, []byte{0x01, 0x00})                                     // ec_point_formats
+	extension(0x0023, nil)                                                    // session_ticket
+	extension(0x0010, []byte{0x00, 0x0c, 0x02, 'h', '2', 0x08, 'h', 't', 't', 'p', '/', '1', '.', '1'})
+	extension(0x000d, []byte{0x00, 0x08, 0x04, 0x03, 0x08, 0x04, 0x04, 0x01, 0x05, 0x03}) // signature_algorithms
+	extension(0x0033, append([]byte{0x00, 0x24, 0x00, 0x1d, 0x00, 0x20}, GenerateNonce(32)...))
+	extension(0x002d, []byte{0x01, 0x01})                   // psk_key_exchange_modes
+	extension(0x002b, []byte{0x04, 0x03, 0x04, 0x03, 0x03}) // supported_versions
+
+	body := new(bytes.Buffer)
+	body.Write([]byte{0x03, 0x03})
+	body.Write(make([]byte, 32)) // random
+	body.WriteByte(32)
+	body.Write(GenerateNonce(32)) // session_id
+	body.Write([]byte{
+		0x00, 0x20,
+		0x13, 0x01, 0x13, 0x02, 0x13, 0x03, 0xc0, 0x2b, 0xc0, 0x2f, 0xc0, 0x2c, 0xc0, 0x30,
+		0xcc, 0xa9, 0xcc, 0xa8, 0xc0, 0x13, 0xc0, 0x14, 0x00, 0x9c, 0x00, 0x9d, 0x00, 0x2f, 0x00, 0x35,
+	})
+	body.Write([]byte{0x01, 0x00}) // compression
+
+	// pad the record to 517 bytes like browsers do
+	if size := 4 + body.Len() + 2 + ext.Len() + 4; size < 512 {
+		extension(0x0015, make([]byte, 512-size))
+	}
+	_ = binary.Write(body, binary.BigEndian, uint16(ext.Len()))
+	body.Write(ext.Bytes())
+
+	x := make([]byte, 9, 9+body.Len())
+	x[0], x[1], x[2] = tlsHandshake, 0x03, 0x01
+	binary.BigEndian.PutUint16(x[3:], uint16(4+body.Len()))
+	binary.BigEndian.PutUint32(x[5:], uint32(body.Len()))
+	x[5] = 0x01 // client_hello
+	return append(x, body.Bytes()...)
+}
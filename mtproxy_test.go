@@ -0,0 +1,105 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseProxySecret(t *testing.T) {
+	cases := []struct {
+		secret string
+		kind   byte
+		domain string
+	}{
+		{"0123456789abcdef0123456789abcdef", proxySecretPlain, ""},
+		{"dd0123456789abcdef0123456789abcdef", proxySecretPadded, ""},
+		{"ee0123456789abcdef0123456789abcdef676f6f676c652e636f6d", proxySecretFakeTLS, "google.com"},
+		{"7gEjRWeJq83vASNFZ4mrze9nb29nbGUuY29t", proxySecretFakeTLS, "google.com"},
+	}
+
+	for _, c := range cases {
+		p, err := parseProxySecret("127.0.0.1:443", c.secret)
+		if err != nil {
+			t.Errorf("%s: %s", c.secret, err)
+			continue
+		}
+		if p.kind != c.kind || p.domain != c.domain || len(p.key) != 16 {
+			t.Errorf("%s: got kind 0x%02x domain %q", c.secret, p.kind, p.domain)
+		}
+	}
+
+	for _, secret := range []string{"", "0123", "ff0123456789abcdef0123456789abcdef"} {
+		if _, err := parseProxySecret("127.0.0.1:443", secret); err == nil {
+			t.Errorf("%q: accepted", secret)
+		}
+	}
+}
+
+func TestFakeTLSHandshake(t *testing.T) {
+	key := GenerateNonce(16)
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fakeTLSServer(server, key)
+	}()
+
+	p := &mtproxy{kind: proxySecretFakeTLS, key: key, domain: "example.com"}
+	conn, err := p.wrap(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fakeTLSServer(conn net.Conn, key []byte) error {
+	hello := make([]byte, 517)
+	if _, err := io.ReadFull(conn, hello); err != nil {
+		return err
+	}
+	clientDigest := make([]byte, 32)
+	copy(clientDigest, hello[11:])
+	copy(hello[11:], make([]byte, 32))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(hello)
+	expected := mac.Sum(nil)
+	skew := int64(binary.LittleEndian.Uint32(expected[28:])^binary.LittleEndian.Uint32(clientDigest[28:])) - time.Now().Unix()
+	if !bytes.Equal(expected[:28], clientDigest[:28]) || skew < -5 || skew > 5 {
+		return io.ErrUnexpectedEOF
+	}
+
+	answer := []byte{tlsHandshake, 0x03, 0x03, 0x00, 0x30}
+	answer = append(answer, make([]byte, 0x30)...)
+	answer = append(answer, tlsChangeCipherSpec, 0x03, 0x03, 0x00, 0x01, 0x01)
+	answer = append(answer, tlsApplicationData, 0x03, 0x03, 0x00, 0x10)
+	answer = append(answer, GenerateNonce(0x10)...)
+	mac.Reset()
+	mac.Write(clientDigest)
+	mac.Write(answer)
+	copy(answer[11:], mac.Sum(nil))
+	if _, err := conn.Write(answer); err != nil {
+		return err
+	}
+
+	record := make([]byte, 6+5+4)
+	if _, err := io.ReadFull(conn, record); err != nil {
+		return err
+	}
+	if !bytes.Equal(record, []byte{0x14, 0x03, 0x03, 0x00, 0x01, 0x01, 0x17, 0x03, 0x03, 0x00, 0x04, 'p', 'i', 'n', 'g'}) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
@@ -8,141 +8,157 @@ import (
 	"time"
 )
 
-func (m *MTProto) sendPacket(msg TL, resp chan TL) error {
+// sendPlain sends an unencrypted message, as used by the key exchange.
+func (m *MTProto) sendPlain(msg TL) error {
 	obj := msg.encode()
 
 	x := NewEncodeBuf(256)
+	x.Long(0)
+	x.Long(m.clock.newMsgId())
+	x.Int(int32(len(obj)))
+	x.Bytes(obj)
 
-	// padding for tcpsize
-	x.Int(0)
-
-	if m.encrypted {
-		needAck := true
-		switch msg.(type) {
-		case TL_ping, TL_msgs_ack:
-			needAck = false
-		}
-		z := NewEncodeBuf(256)
-		newMsgId := GenerateMessageId()
-		z.Bytes(m.serverSalt)
-		z.Long(m.sessionId)
-		z.Long(newMsgId)
-		if needAck {
-			z.Int(m.lastSeqNo | 1)
-		} else {
-			z.Int(m.lastSeqNo)
-		}
-		z.Int(int32(len(obj)))
-		z.Bytes(obj)
-
-		msgKey := sha1(z.buf)[4:20]
-		aesKey, aesIV := generateAES(msgKey, m.authKey, false)
-
-		y := make([]byte, len(z.buf)+((16-(len(obj)%16))&15))
-		copy(y, z.buf)
-		encryptedData, err := doAES256IGEencrypt(y, aesKey, aesIV)
-		if err != nil {
-			return err
-		}
-
-		m.lastSeqNo += 2
-		if needAck {
-			m.mutex.Lock()
-			m.msgsIdToAck[newMsgId] = packetToSend{msg, resp}
-			m.mutex.Unlock()
-		}
-
-		x.Bytes(m.authKeyHash)
-		x.Bytes(msgKey)
-		x.Bytes(encryptedData)
+	return m.conn.WritePacket(x.buf, false)
+}
 
-		if resp != nil {
-			m.mutex.Lock()
-			m.msgsIdToResp[newMsgId] = resp
-			m.mutex.Unlock()
-		}
+// sendMessage encrypts msg with the current auth key and sends it with the given msg_id.
+func (m *MTProto) sendMessage(newMsgId int64, msg TL, resp chan TL) error {
+	p, err := m.packMessages([]outMessage{{newMsgId, msg.encode(), packetToSend{msg, resp}}})
+	if err != nil {
+		return err
+	}
+	return m.writePacket(p)
+}
 
+// encryptMessage encrypts the plaintext of a message with authKey, using MTProto 2.0 if mtproto2 is set.
+// It returns msg_key, the encrypted data and the token of a quick ack for the message.
+func encryptMessage(authKey, plain []byte, mtproto2 bool) ([]byte, []byte, uint32, error) {
+	var msgKey, y, token []byte
+	var aesKey, aesIV []byte
+
+	if mtproto2 {
+		// 12-1024 random bytes, the random number of blocks hides the message size
+		padding := 12 + (16-(len(plain)+12)%16)%16 + 16*int(GenerateNonce(1)[0]&15)
+		y = append(append(y, plain...), GenerateNonce(padding)...)
+		msgKeyLarge := sha256Sum(authKey[88:88+32], y)
+		msgKey = msgKeyLarge[8:24]
+		token = msgKeyLarge[0:4]
+		aesKey, aesIV = generateAES2(msgKey, authKey, false)
 	} else {
-		x.Long(0)
-		x.Long(GenerateMessageId())
-		x.Int(int32(len(obj)))
-		x.Bytes(obj)
+		hash := sha1(plain)
+		msgKey = hash[4:20]
+		token = hash[0:4]
+		y = make([]byte, len(plain)+((16-(len(plain)%16))&15))
+		copy(y, plain)
+		aesKey, aesIV = generateAES(msgKey, authKey, false)
+	}
 
+	encryptedData, err := doAES256IGEencrypt(y, aesKey, aesIV)
+	if err != nil {
+		return nil, nil, 0, err
 	}
 
-	// minus padding
-	size := len(x.buf)/4 - 1
+	return msgKey, encryptedData, binary.LittleEndian.Uint32(token) | 0x80000000, nil
+}
 
-	if size < 127 {
-		x.buf[3] = byte(size)
-		x.buf = x.buf[3:]
+// decryptMessage decrypts a message from the server with authKey and checks its msg_key and length.
+// The result still has the padding at the end.
+func decryptMessage(authKey, msgKey, data []byte, mtproto2 bool) ([]byte, error) {
+	var aesKey, aesIV []byte
+	if mtproto2 {
+		aesKey, aesIV = generateAES2(msgKey, authKey, true)
 	} else {
-		binary.LittleEndian.PutUint32(x.buf, uint32(size<<8|127))
+		aesKey, aesIV = generateAES(msgKey, authKey, true)
 	}
-	_, err := m.conn.Write(x.buf)
+	x, err := doAES256IGEdecrypt(data, aesKey, aesIV)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(x) < 32 {
+		return nil, fmt.Errorf("Message too short: %d", len(x))
 	}
 
-	return nil
+	if mtproto2 && !bytes.Equal(sha256Sum(authKey[96:96+32], x)[8:24], msgKey) {
+		return nil, errors.New("Wrong msg_key")
+	}
+	messageLen := int(int32(binary.LittleEndian.Uint32(x[28:])))
+	if messageLen < 0 || messageLen > len(x)-32 {
+		return nil, fmt.Errorf("Message len: %d (need less than %d)", messageLen, len(x)-32)
+	}
+	if mtproto2 {
+		padding := len(x) - 32 - messageLen
+		if padding < 12 || padding > 1024 {
+			return nil, fmt.Errorf("Wrong padding: %d", padding)
+		}
+	} else {
+		if padding := len(x) - 32 - messageLen; padding > 15 {
+			return nil, fmt.Errorf("Wrong padding: %d", padding)
+		}
+		if !bytes.Equal(sha1(x[0 : 32+messageLen])[4:20], msgKey) {
+			return nil, errors.New("Wrong msg_key")
+		}
+	}
+
+	return x, nil
 }
 
 func (m *MTProto) read(stop <-chan struct{}) (interface{}, error) {
-	var err error
-	var n int
-	var size int
-	var data interface{}
-
-	err = m.conn.SetReadDeadline(time.Now().Add(300 * time.Second))
-	if err != nil {
-		return nil, err
-	}
-	b := make([]byte, 1)
-	n, err = m.conn.Read(b)
-	if stop != nil {
-		select {
-		case <-stop:
-			return nil, nil
-		default:
+	for {
+		data, err := m.readMessage(stop)
+		if err != errMessageDropped {
+			return data, err
 		}
 	}
-	if err != nil {
-		return nil, err
-	}
+}
 
-	if b[0] < 127 {
-		size = int(b[0]) << 2
-	} else {
-		b := make([]byte, 3)
-		n, err = m.conn.Read(b)
+// readMessage reads the next message. Encrypted messages which must not be processed,
+// because they are replayed or don't belong to the session, give errMessageDropped.
+// https://core.telegram.org/mtproto/security_guidelines
+func (m *MTProto) readMessage(stop <-chan struct{}) (interface{}, error) {
+	var err error
+	var data interface{}
+
+	var buf []byte
+	for {
+		err = m.conn.SetReadDeadline(time.Now().Add(300 * time.Second))
 		if err != nil {
 			return nil, err
 		}
-		size = (int(b[0]) | int(b[1])<<8 | int(b[2])<<16) << 2
-	}
-
-	left := size
-	buf := make([]byte, size)
-	for left > 0 {
-		n, err = m.conn.Read(buf[size-left:])
+		var token uint32
+		buf, token, err = m.conn.ReadPacket()
+		if stop != nil {
+			select {
+			case <-stop:
+				return nil, nil
+			default:
+			}
+		}
 		if err != nil {
 			return nil, err
 		}
-		left -= n
+		if token == 0 {
+			break
+		}
+		m.quickAcked(token)
 	}
 
-	if size == 4 {
-		return nil, fmt.Errorf("Server response error: %d", int32(binary.LittleEndian.Uint32(buf)))
+	if len(buf) == 4 {
+		return nil, TransportError{int32(binary.LittleEndian.Uint32(buf))}
 	}
 
 	dbuf := NewDecodeBuf(buf)
 
 	authKeyHash := dbuf.Bytes(8)
 	if binary.LittleEndian.Uint64(authKeyHash) == 0 {
+		if m.encrypted && !m.exchanging {
+			// nothing but the key exchange is trusted without encryption
+			return nil, errors.New("Unencrypted message out of the key exchange")
+		}
 		m.msgId = dbuf.Long()
 		messageLen := dbuf.Int()
-		if int(messageLen) != dbuf.size-20 {
-			return nil, fmt.Errorf("Message len: %d (need %d)", messageLen, dbuf.size-20)
+		// transports with random padding may leave trailing bytes
+		if int(messageLen) > dbuf.size-20 {
+			return nil, fmt.Errorf("Message len: %d (need less than %d)", messageLen, dbuf.size-20)
 		}
 		m.seqNo = 0
 
@@ -153,29 +169,47 @@ func (m *MTProto) read(stop <-chan struct{}) (interface{}, error) {
 
 	} else {
 		msgKey := dbuf.Bytes(16)
-		encryptedData := dbuf.Bytes(dbuf.size - 24)
-		aesKey, aesIV := generateAES(msgKey, m.authKey, true)
-		x, err := doAES256IGEdecrypt(encryptedData, aesKey, aesIV)
+		encryptedData := dbuf.Bytes((dbuf.size - 24) &^ 15)
+		if dbuf.err != nil {
+			return nil, dbuf.err
+		}
+		authKey, keyId := m.sessionKey()
+		if !bytes.Equal(authKeyHash, keyId) {
+			return nil, fmt.Errorf("Wrong auth_key_id: %x", authKeyHash)
+		}
+		x, err := decryptMessage(authKey, msgKey, encryptedData, m.mtproto2)
 		if err != nil {
 			return nil, err
 		}
 		dbuf = NewDecodeBuf(x)
 		_ = dbuf.Long() // salt
-		_ = dbuf.Long() // session_id
-		m.msgId = dbuf.Long()
-		m.seqNo = dbuf.Int()
-		messageLen := dbuf.Int()
-		if int(messageLen) > dbuf.size-32 {
-			return nil, fmt.Errorf("Message len: %d (need less than %d)", messageLen, dbuf.size-32)
-		}
-		if !bytes.Equal(sha1(dbuf.buf[0 : 32+messageLen])[4:20], msgKey) {
-			return nil, errors.New("Wrong msg_key")
+		sessionId := dbuf.Long()
+		msgId := dbuf.Long()
+		seqNo := dbuf.Int()
+		_ = dbuf.Int() // message_data_length, checked by decryptMessage
+
+		m.mutex.Lock()
+		ourSession := sessionId == m.sessionId
+		m.mutex.Unlock()
+		if !ourSession {
+			return nil, errMessageDropped
 		}
-
 		data = dbuf.Object()
 		if dbuf.err != nil {
 			return nil, dbuf.err
 		}
+		if !m.clock.inWindow(msgId) && !clockFix(data) {
+			return nil, errMessageDropped
+		}
+		if !m.received.add(msgId) {
+			// acknowledge it again, the server resends it because the ack got lost
+			if seqNo&1 == 1 {
+				m.enqueue(packetToSend{TL_msgs_ack{[]int64{msgId}}, nil})
+			}
+			return nil, errMessageDropped
+		}
+		m.msgId, m.seqNo = msgId, seqNo
+		m.clock.observe(m.msgId)
 
 	}
 	mod := m.msgId & 3
@@ -187,71 +221,135 @@ func (m *MTProto) read(stop <-chan struct{}) (interface{}, error) {
 }
 
 func (m *MTProto) makeAuthKey() error {
+	authKey, serverSalt, err := m.exchangeKey(0)
+	if err != nil {
+		return err
+	}
+	m.authKey = authKey
+	m.authKeyHash = sha1(authKey)[12:20]
+	m.serverSalt = serverSalt
+
+	return m.saveData()
+}
+
+const (
+	// times the key exchange is started over after the server refused it
+	handshakeAttempts = 3
+	// dh_gen_retry answers accepted within one exchange
+	dhGenRetries = 5
+)
+
+// exchangeKey creates a new auth key with the DH exchange and returns it with the first server salt.
+// A key with a positive expiresIn is a temporary one which the server forgets after expiresIn seconds.
+// The exchange starts over when the server refuses it, up to handshakeAttempts times.
+func (m *MTProto) exchangeKey(expiresIn int32) ([]byte, []byte, error) {
+	m.exchanging = true
+	defer func() { m.exchanging = false }()
+
+	var err error
+	for attempt := 0; attempt < handshakeAttempts; attempt++ {
+		var authKey, serverSalt []byte
+		authKey, serverSalt, err = m.runHandshake(expiresIn)
+		switch err {
+		case nil:
+			return authKey, serverSalt, nil
+		case ErrDHParamsFail, ErrDHGenFail, ErrDHGenRetry:
+			continue
+		}
+		// a broken connection or an answer which can't be trusted
+		return nil, nil, err
+	}
+
+	return nil, nil, HandshakeError{handshakeAttempts, err}
+}
+
+// runHandshake makes one attempt of the DH exchange.
+// https://core.telegram.org/mtproto/auth_key
+func (m *MTProto) runHandshake(expiresIn int32) ([]byte, []byte, error) {
 	var x []byte
 	var err error
 	var data interface{}
 
 	// (send) req_pq
 	nonceFirst := GenerateNonce(16)
-	err = m.sendPacket(TL_req_pq{nonceFirst}, nil)
+	err = m.sendPlain(TL_req_pq{nonceFirst})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	// (parse) resPQ
 	data, err = m.read(nil)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	res, ok := data.(TL_resPQ)
 	if !ok {
-		return errors.New("Handshake: Need resPQ")
+		return nil, nil, errors.New("Handshake: Need resPQ")
 	}
 	if !bytes.Equal(nonceFirst, res.nonce) {
-		return errors.New("Handshake: Wrong nonce")
-	}
-	found := false
-	for _, b := range res.fingerprints {
-		if uint64(b) == telegramPublicKey_FP {
-			found = true
-			break
-		}
+		return nil, nil, errors.New("Handshake: Wrong nonce")
 	}
-	if !found {
-		return errors.New("Handshake: No fingerprint")
+	fingerprint, key, ok := m.rsaKeys.find(res.fingerprints)
+	if !ok {
+		return nil, nil, errors.New("Handshake: No fingerprint")
 	}
 
 	// (encoding) p_q_inner_data
 	p, q := splitPQ(res.pq)
 	nonceSecond := GenerateNonce(32)
 	nonceServer := res.server_nonce
-	innerData1 := (TL_p_q_inner_data{res.pq, p, q, nonceFirst, nonceServer, nonceSecond}).encode()
-
-	x = make([]byte, 255)
-	copy(x[0:], sha1(innerData1))
-	copy(x[20:], innerData1)
-	encryptedData1 := doRSAencrypt(x)
+	var innerData1, encryptedData1 []byte
+	if key.pad {
+		if expiresIn > 0 {
+			innerData1 = (TL_p_q_inner_data_temp_dc{res.pq, p, q, nonceFirst, nonceServer, nonceSecond, m.dcId, expiresIn}).encode()
+		} else {
+			innerData1 = (TL_p_q_inner_data_dc{res.pq, p, q, nonceFirst, nonceServer, nonceSecond, m.dcId}).encode()
+		}
+		encryptedData1, err = rsaPadEncrypt(key.key, innerData1)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		if expiresIn > 0 {
+			innerData1 = (TL_p_q_inner_data_temp{res.pq, p, q, nonceFirst, nonceServer, nonceSecond, expiresIn}).encode()
+		} else {
+			innerData1 = (TL_p_q_inner_data{res.pq, p, q, nonceFirst, nonceServer, nonceSecond}).encode()
+		}
+		x = make([]byte, 255)
+		copy(x[0:], sha1(innerData1))
+		copy(x[20:], innerData1)
+		copy(x[20+len(innerData1):], GenerateNonce(255-20-len(innerData1)))
+		encryptedData1 = doRSAencrypt(key.key, x)
+	}
 
 	// (send) req_DH_params
-	err = m.sendPacket(TL_req_DH_params{nonceFirst, nonceServer, p, q, telegramPublicKey_FP, encryptedData1}, nil)
+	err = m.sendPlain(TL_req_DH_params{nonceFirst, nonceServer, p, q, fingerprint, encryptedData1})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	// (parse) server_DH_params_{ok, fail}
 	data, err = m.read(nil)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	if fail, ok := data.(TL_server_DH_params_fail); ok {
+		err = checkNonces(nonceFirst, nonceServer, fail.nonce, fail.server_nonce)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(sha1(nonceSecond)[4:20], fail.new_nonce_hash) {
+			return nil, nil, errors.New("Handshake: Wrong new_nonce_hash")
+		}
+		return nil, nil, ErrDHParamsFail
 	}
 	dh, ok := data.(TL_server_DH_params_ok)
 	if !ok {
-		return errors.New("Handshake: Need server_DH_params_ok")
+		return nil, nil, errors.New("Handshake: Need server_DH_params_ok")
 	}
-	if !bytes.Equal(nonceFirst, dh.nonce) {
-		return errors.New("Handshake: Wrong nonce")
-	}
-	if !bytes.Equal(nonceServer, dh.server_nonce) {
-		return errors.New("Handshake: Wrong server_nonce")
+	err = checkNonces(nonceFirst, nonceServer, dh.nonce, dh.server_nonce)
+	if err != nil {
+		return nil, nil, err
 	}
 	t1 := make([]byte, 48)
 	copy(t1[0:], nonceSecond)
@@ -281,76 +379,139 @@ func (m *MTProto) makeAuthKey() error {
 	// (parse-thru) server_DH_inner_data
 	decodedData, err := doAES256IGEdecrypt(dh.encrypted_answer, tmpAESKey, tmpAESIV)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	if len(decodedData) < 20 {
+		return nil, nil, errors.New("Handshake: server_DH_inner_data too short")
 	}
 	innerbuf := NewDecodeBuf(decodedData[20:])
 	data = innerbuf.Object()
 	if innerbuf.err != nil {
-		return innerbuf.err
+		return nil, nil, innerbuf.err
+	}
+	// SHA1(answer) + answer + 0-15 bytes of padding
+	if len(decodedData)-20-innerbuf.off > 15 {
+		return nil, nil, errors.New("Handshake: Wrong server_DH_inner_data padding")
+	}
+	if !bytes.Equal(sha1(decodedData[20:20+innerbuf.off]), decodedData[:20]) {
+		return nil, nil, errors.New("Handshake: Wrong server_DH_inner_data hash")
 	}
 	dhi, ok := data.(TL_server_DH_inner_data)
 	if !ok {
-		return errors.New("Handshake: Need server_DH_inner_data")
+		return nil, nil, errors.New("Handshake: Need server_DH_inner_data")
 	}
-	if !bytes.Equal(nonceFirst, dhi.nonce) {
-		return errors.New("Handshake: Wrong nonce")
-	}
-	if !bytes.Equal(nonceServer, dhi.server_nonce) {
-		return errors.New("Handshake: Wrong server_nonce")
+	err = checkNonces(nonceFirst, nonceServer, dhi.nonce, dhi.server_nonce)
+	if err != nil {
+		return nil, nil, err
 	}
-
-	_, g_b, g_ab := makeGAB(dhi.g, dhi.g_a, dhi.dh_prime)
-	m.authKey = g_ab.Bytes()
-	if m.authKey[0] == 0 {
-		m.authKey = m.authKey[1:]
-	}
-	m.authKeyHash = sha1(m.authKey)[12:20]
-	t4 := make([]byte, 32+1+8)
-	copy(t4[0:], nonceSecond)
-	t4[32] = 1
-	copy(t4[33:], sha1(m.authKey)[0:8])
-	nonceHash1 := sha1(t4)[4:20]
-	m.serverSalt = make([]byte, 8)
-	copy(m.serverSalt, nonceSecond[:8])
-	xor(m.serverSalt, nonceServer[:8])
-
-	// (encoding) client_DH_inner_data
-	innerData2 := (TL_client_DH_inner_data{nonceFirst, nonceServer, 0, g_b}).encode()
-	x = make([]byte, 20+len(innerData2)+(16-((20+len(innerData2))%16))&15)
-	copy(x[0:], sha1(innerData2))
-	copy(x[20:], innerData2)
-	encryptedData2, err := doAES256IGEencrypt(x, tmpAESKey, tmpAESIV)
-
-	// (send) set_client_DH_params
-	err = m.sendPacket(TL_set_client_DH_params{nonceFirst, nonceServer, encryptedData2}, nil)
+	err = checkDHParams(dhi.g, dhi.dh_prime, dhi.g_a)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	m.clock.setServerTime(time.Unix(int64(dhi.server_time), 0))
+	serverSalt := make([]byte, 8)
+	copy(serverSalt, nonceSecond[:8])
+	xor(serverSalt, nonceServer[:8])
 
-	// (parse) dh_gen_{ok, retry, fail}
-	data, err = m.read(nil)
+	authKey, err := m.setClientDHParams(nonceFirst, nonceServer, nonceSecond, tmpAESKey, tmpAESIV, dhi)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	dhg, ok := data.(TL_dh_gen_ok)
-	if !ok {
-		return errors.New("Handshake: Need dh_gen_ok")
+
+	// (all ok)
+	return authKey, serverSalt, nil
+}
+
+// setClientDHParams sends g_b and returns the auth key once the server accepts it,
+// trying again with a new b on dh_gen_retry.
+func (m *MTProto) setClientDHParams(nonceFirst, nonceServer, nonceSecond, tmpAESKey, tmpAESIV []byte, dhi TL_server_DH_inner_data) ([]byte, error) {
+	var retryId int64
+	var data interface{}
+	for retry := 0; ; retry++ {
+		_, g_b, g_ab := makeGAB(dhi.g, dhi.g_a, dhi.dh_prime)
+		authKey := g_ab.Bytes()
+		if authKey[0] == 0 {
+			authKey = authKey[1:]
+		}
+
+		// (encoding) client_DH_inner_data
+		innerData2 := (TL_client_DH_inner_data{nonceFirst, nonceServer, retryId, g_b}).encode()
+		x := make([]byte, 20+len(innerData2)+(16-((20+len(innerData2))%16))&15)
+		copy(x[0:], sha1(innerData2))
+		copy(x[20:], innerData2)
+		encryptedData2, err := doAES256IGEencrypt(x, tmpAESKey, tmpAESIV)
+		if err != nil {
+			return nil, err
+		}
+
+		// (send) set_client_DH_params
+		err = m.sendPlain(TL_set_client_DH_params{nonceFirst, nonceServer, encryptedData2})
+		if err != nil {
+			return nil, err
+		}
+
+		// (parse) dh_gen_{ok, retry, fail}
+		data, err = m.read(nil)
+		if err != nil {
+			return nil, err
+		}
+		switch dhg := data.(type) {
+		case TL_dh_gen_ok:
+			err = checkNonces(nonceFirst, nonceServer, dhg.nonce, dhg.server_nonce)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(newNonceHash(nonceSecond, 1, authKey), dhg.new_nonce_hash1) {
+				return nil, errors.New("Handshake: Wrong new_nonce_hash1")
+			}
+			return authKey, nil
+
+		case TL_dh_gen_retry:
+			err = checkNonces(nonceFirst, nonceServer, dhg.nonce, dhg.server_nonce)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(newNonceHash(nonceSecond, 2, authKey), dhg.new_nonce_hash2) {
+				return nil, errors.New("Handshake: Wrong new_nonce_hash2")
+			}
+			if retry+1 >= dhGenRetries {
+				return nil, ErrDHGenRetry
+			}
+			// retry with a new b, telling the server which key failed
+			retryId = int64(binary.LittleEndian.Uint64(sha1(authKey)[0:8]))
+
+		case TL_dh_gen_fail:
+			err = checkNonces(nonceFirst, nonceServer, dhg.nonce, dhg.server_nonce)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(newNonceHash(nonceSecond, 3, authKey), dhg.new_nonce_hash3) {
+				return nil, errors.New("Handshake: Wrong new_nonce_hash3")
+			}
+			return nil, ErrDHGenFail
+
+		default:
+			return nil, errors.New("Handshake: Need dh_gen_ok")
+		}
 	}
-	if !bytes.Equal(nonceFirst, dhg.nonce) {
+}
+
+// checkNonces compares the nonces of a handshake answer with the ones of the exchange.
+func checkNonces(nonce, serverNonce, gotNonce, gotServerNonce []byte) error {
+	if !bytes.Equal(nonce, gotNonce) {
 		return errors.New("Handshake: Wrong nonce")
 	}
-	if !bytes.Equal(nonceServer, dhg.server_nonce) {
+	if !bytes.Equal(serverNonce, gotServerNonce) {
 		return errors.New("Handshake: Wrong server_nonce")
 	}
-	if !bytes.Equal(nonceHash1, dhg.new_nonce_hash1) {
-		return errors.New("Handshake: Wrong new_nonce_hash1")
-	}
-
-	// (all ok)
-	err = m.saveData()
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
+
+// newNonceHash returns new_nonce_hash1, 2 or 3 expected in dh_gen_ok, dh_gen_retry or dh_gen_fail.
+func newNonceHash(newNonce []byte, n byte, authKey []byte) []byte {
+	x := make([]byte, 32+1+8)
+	copy(x[0:], newNonce)
+	x[32] = n
+	copy(x[33:], sha1(authKey)[0:8])
+	return sha1(x)[4:20]
+}
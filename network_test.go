@@ -0,0 +1,214 @@
+package mtproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMTProto2Encrypt(t *testing.T) {
+	m := newTestMTProto(nil)
+	m.mtproto2 = true
+
+	for _, size := range []int{0, 4, 12, 16, 100, 4096} {
+		plain := GenerateNonce(32 + size)
+		binary.LittleEndian.PutUint32(plain[28:], uint32(size))
+		msgKey, data, _, err := encryptMessage(m.authKey, plain, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// decrypt it the way the server does
+		aesKey, aesIV := generateAES2(msgKey, m.authKey, false)
+		y, err := doAES256IGEdecrypt(data, aesKey, aesIV)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(sha256Sum(m.authKey[88:88+32], y)[8:24], msgKey) {
+			t.Errorf("%d: wrong msg_key", size)
+		}
+		if padding := len(y) - len(plain); padding < 12 || padding > 1024 {
+			t.Errorf("%d: wrong padding %d", size, padding)
+		}
+		if !bytes.Equal(y[:len(plain)], plain) {
+			t.Errorf("%d: wrong plaintext", size)
+		}
+	}
+}
+
+func TestMTProto2Read(t *testing.T) {
+	m := newTestMTProto(nil)
+	m.mtproto2 = true
+	client, server := net.Pipe()
+	defer server.Close()
+	m.conn = &streamConn{client, NewIntermediateTransport()}
+
+	obj := NewEncodeBuf(64)
+	obj.UInt(crc_rpc_error)
+	obj.Int(400)
+	obj.String("BAD_REQUEST")
+	go NewIntermediateTransport().WritePacket(server, serverPacket(m, 0, obj.buf), false)
+	x, err := m.read(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, ok := x.(TL_rpc_error); !ok || x.error_code != 400 {
+		t.Errorf("Got %#v", x)
+	}
+
+	packet := serverPacket(m, 0, obj.buf)
+	packet[len(packet)-1] ^= 1
+	go NewIntermediateTransport().WritePacket(server, packet, false)
+	if _, err = m.read(nil); err == nil {
+		t.Error("Corrupted message accepted")
+	}
+
+	// a message encrypted with the old scheme
+	m.mtproto2 = false
+	packet = serverPacket(m, 0, obj.buf)
+	m.mtproto2 = true
+	go NewIntermediateTransport().WritePacket(server, packet, false)
+	if _, err = m.read(nil); err == nil {
+		t.Error("MTProto 1.0 message accepted")
+	}
+}
+
+func TestReadSyncsSkewedClock(t *testing.T) {
+	// a saved key and a local clock two minutes slow
+	m := newTestMTProto(nil)
+	client, server := net.Pipe()
+	defer server.Close()
+	m.conn = &streamConn{client, NewIntermediateTransport()}
+	serverTime := time.Now().Add(2 * time.Minute)
+
+	obj := NewEncodeBuf(64)
+	obj.UInt(crc_rpc_error)
+	obj.Int(400)
+	obj.String("ERROR")
+	go func() {
+		for _, p := range [][]byte{
+			serverPacketId(m, msgIdAt(serverTime)|1, 0, obj.buf),
+			serverPacketId(m, msgIdAt(serverTime.Add(time.Hour))|1, 0, obj.buf),
+			serverPacketId(m, msgIdAt(serverTime.Add(time.Second))|1, 0, obj.buf),
+		} {
+			NewIntermediateTransport().WritePacket(server, p, false)
+		}
+	}()
+	for _, want := range []time.Time{serverTime, serverTime.Add(time.Second)} {
+		if _, err := m.read(nil); err != nil {
+			t.Fatal(err)
+		}
+		if msgIdTime(m.msgId).Unix() != want.Unix() {
+			t.Errorf("Got the message from %s instead of %s", msgIdTime(m.msgId), want)
+		}
+	}
+	if d := msgIdTime(m.clock.newMsgId()).Sub(serverTime); d < -time.Second || d > 2*time.Second {
+		t.Errorf("msg_id is %s off the server time", d)
+	}
+}
+
+func TestReadRejectsPlainMessages(t *testing.T) {
+	m := newTestMTProto(nil)
+	client, server := net.Pipe()
+	defer server.Close()
+	m.conn = &streamConn{client, NewIntermediateTransport()}
+
+	x := NewEncodeBuf(64)
+	x.Long(0)
+	x.Long(GenerateMessageId() | 1)
+	x.Int(4)
+	x.UInt(crc_msgs_ack)
+	go NewIntermediateTransport().WritePacket(server, x.buf, false)
+	if _, err := m.read(nil); err == nil {
+		t.Error("Unencrypted message accepted in a session")
+	}
+}
+
+func TestReadDropsForeignMessages(t *testing.T) {
+	m := newTestMTProto(nil)
+	client, server := net.Pipe()
+	defer server.Close()
+	m.conn = &streamConn{client, NewIntermediateTransport()}
+	write := func(packets ...[]byte) {
+		go func() {
+			for _, p := range packets {
+				NewIntermediateTransport().WritePacket(server, p, false)
+			}
+		}()
+	}
+	rpcError := func(code int32) []byte {
+		obj := NewEncodeBuf(64)
+		obj.UInt(crc_rpc_error)
+		obj.Int(code)
+		obj.String("ERROR")
+		return obj.buf
+	}
+
+	// a replay and a message of another session
+	first := serverPacket(m, 0, rpcError(1))
+	m.sessionId++
+	foreign := serverPacket(m, 0, rpcError(2))
+	m.sessionId--
+	write(first, first, foreign, serverPacket(m, 0, rpcError(3)))
+	for _, code := range []int32{1, 3} {
+		x, err := m.read(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if x, ok := x.(TL_rpc_error); !ok || x.error_code != code {
+			t.Errorf("Got %#v instead of error %d", x, code)
+		}
+	}
+
+	// messages from an hour ahead of the server time, except the one which fixes the clock
+	m.clock.setServerTime(time.Now().Add(-time.Hour))
+	badMsg := NewEncodeBuf(32)
+	badMsg.UInt(crc_bad_msg_notification)
+	badMsg.Long(GenerateMessageId())
+	badMsg.Int(1)
+	badMsg.Int(17)
+	write(serverPacket(m, 0, rpcError(4)), serverPacket(m, 0, badMsg.buf))
+	x, err := m.read(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if x, ok := x.(TL_crc_bad_msg_notification); !ok || x.error_code != 17 {
+		t.Errorf("Got %#v instead of bad_msg_notification", x)
+	}
+}
+
+func TestReadDropsStaleMessages(t *testing.T) {
+	// a saved key, so the clock was never synced with the server
+	m := newTestMTProto(nil)
+	client, server := net.Pipe()
+	defer server.Close()
+	m.conn = &streamConn{client, NewIntermediateTransport()}
+
+	obj := NewEncodeBuf(64)
+	obj.UInt(crc_rpc_error)
+	obj.Int(400)
+	obj.String("ERROR")
+	go func() {
+		for _, p := range [][]byte{
+			serverPacket(m, 0, obj.buf),
+			serverPacketId(m, msgIdAt(time.Now().Add(-time.Hour))|1, 0, obj.buf),
+			serverPacketId(m, msgIdAt(time.Now().Add(time.Minute))|1, 0, obj.buf),
+			serverPacket(m, 0, obj.buf),
+		} {
+			NewIntermediateTransport().WritePacket(server, p, false)
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		if _, err := m.read(nil); err != nil {
+			t.Fatal(err)
+		}
+		if d := msgIdTime(m.msgId).Sub(time.Now()); d < -time.Minute || d > time.Second {
+			t.Errorf("Message %s from now accepted", d)
+		}
+	}
+	if d := msgIdTime(m.clock.newMsgId()).Sub(time.Now()); d < -time.Second || d > time.Second {
+		t.Errorf("Stale message moved the clock by %s", d)
+	}
+}
@@ -0,0 +1,118 @@
+package mtproto
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// https://core.telegram.org/mtproto/mtproto-transports#transport-obfuscation
+type obfuscatedTransport struct {
+	inner   Transport
+	encrypt cipher.Stream
+	decrypt cipher.Stream
+
+	// MTProxy only
+	secret []byte
+	dc     int16
+}
+
+// NewObfuscatedTransport wraps the abridged or (padded) intermediate transport
+// into the obfuscated2 protocol: the connection starts with a random 64-byte
+// header and all further traffic is encrypted with AES-256-CTR.
+//
+//	mtproto.WithTransport(func() mtproto.Transport {
+//		return mtproto.NewObfuscatedTransport(mtproto.NewIntermediateTransport())
+//	})
+func NewObfuscatedTransport(inner Transport) Transport {
+	return &obfuscatedTransport{inner: inner}
+}
+
+func (t *obfuscatedTransport) Init(w io.Writer) error {
+	tagged, ok := t.inner.(taggedTransport)
+	if !ok {
+		return errors.New("Obfuscated: transport has no protocol tag")
+	}
+
+	header := generateObfuscatedHeader(tagged.protocolTag())
+	binary.LittleEndian.PutUint16(header[60:], uint16(t.dc))
+	reversed := make([]byte, 48)
+	for i := range reversed {
+		reversed[i] = header[55-i]
+	}
+
+	encryptKey, decryptKey := header[8:40], reversed[0:32]
+	if t.secret != nil {
+		encryptKey = sha256Sum(encryptKey, t.secret)
+		decryptKey = sha256Sum(decryptKey, t.secret)
+	}
+
+	var err error
+	t.encrypt, err = newAES256CTR(encryptKey, header[40:56])
+	if err != nil {
+		return err
+	}
+	t.decrypt, err = newAES256CTR(decryptKey, reversed[32:48])
+	if err != nil {
+		return err
+	}
+
+	// only the protocol tag and the rest of the header are sent encrypted
+	encrypted := make([]byte, 64)
+	t.encrypt.XORKeyStream(encrypted, header)
+	copy(encrypted, header[:56])
+
+	_, err = w.Write(encrypted)
+	return err
+}
+
+func (t *obfuscatedTransport) WritePacket(w io.Writer, data []byte, quickAck bool) error {
+	if t.encrypt == nil {
+		return errors.New("Obfuscated: not initialized")
+	}
+	return t.inner.WritePacket(cipher.StreamWriter{S: t.encrypt, W: w}, data, quickAck)
+}
+
+func (t *obfuscatedTransport) ReadPacket(r io.Reader) ([]byte, uint32, error) {
+	if t.decrypt == nil {
+		return nil, 0, errors.New("Obfuscated: not initialized")
+	}
+	return t.inner.ReadPacket(cipher.StreamReader{S: t.decrypt, R: r})
+}
+
+func sha256Sum(data ...[]byte) []byte {
+	h := sha256.New()
+	for _, v := range data {
+		_, _ = h.Write(v)
+	}
+	return h.Sum(nil)
+}
+
+// generateObfuscatedHeader returns random bytes which cannot be confused
+// with the start of any other protocol the server accepts on the same port.
+func generateObfuscatedHeader(tag []byte) []byte {
+	for {
+		header := GenerateNonce(64)
+		if header[0] == 0xef {
+			continue
+		}
+		switch binary.LittleEndian.Uint32(header) {
+		case 0x44414548, // HEAD
+			0x54534f50, // POST
+			0x20544547, // GET
+			0x4954504f, // OPTI
+			0x02010316, // TLS handshake
+			0xdddddddd,
+			0xeeeeeeee:
+			continue
+		}
+		if binary.LittleEndian.Uint32(header[4:]) == 0 {
+			continue
+		}
+
+		copy(header[56:60], tag)
+		return header
+	}
+}
@@ -0,0 +1,61 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"testing"
+)
+
+func TestObfuscatedTransport(t *testing.T) {
+	var wire bytes.Buffer
+	client := NewObfuscatedTransport(NewIntermediateTransport())
+	if err := client.Init(&wire); err != nil {
+		t.Fatal(err)
+	}
+	packet := GenerateNonce(128)
+	if err := client.WritePacket(&wire, packet, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// server side: keys are taken from the header in the opposite order
+	header := wire.Next(64)
+	reversed := make([]byte, 48)
+	for i := range reversed {
+		reversed[i] = header[55-i]
+	}
+	serverDecrypt, _ := newAES256CTR(header[8:40], header[40:56])
+	serverEncrypt, _ := newAES256CTR(reversed[0:32], reversed[32:48])
+
+	decrypted := make([]byte, 64)
+	serverDecrypt.XORKeyStream(decrypted, header)
+	if !bytes.Equal(decrypted[56:60], []byte{0xee, 0xee, 0xee, 0xee}) {
+		t.Fatalf("Wrong protocol tag: %x", decrypted[56:60])
+	}
+
+	x, _, err := NewIntermediateTransport().ReadPacket(cipher.StreamReader{S: serverDecrypt, R: &wire})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(x, packet) {
+		t.Fatal("Client packet mismatch")
+	}
+
+	err = NewIntermediateTransport().WritePacket(cipher.StreamWriter{S: serverEncrypt, W: &wire}, packet, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, _, err = client.ReadPacket(&wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(x, packet) {
+		t.Fatal("Server packet mismatch")
+	}
+}
+
+func TestObfuscatedTransportNeedsTag(t *testing.T) {
+	var wire bytes.Buffer
+	if err := NewObfuscatedTransport(NewFullTransport()).Init(&wire); err == nil {
+		t.Error("Full transport accepted")
+	}
+}
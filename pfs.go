@@ -0,0 +1,187 @@
+package mtproto
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// a temporary key is replaced this long before it expires
+const tempKeyRenewBefore = time.Minute
+
+// sessionKey returns the auth key messages are encrypted with and its id:
+// the temporary key with PFS, the permanent one otherwise.
+func (m *MTProto) sessionKey() ([]byte, []byte) {
+	if m.tempAuthKey != nil {
+		return m.tempAuthKey, m.tempAuthKeyHash
+	}
+	return m.authKey, m.authKeyHash
+}
+
+// needTempKey tells whether connect has to make a new temporary key.
+func (m *MTProto) needTempKey() bool {
+	if m.tempKeyTTL == 0 {
+		return false
+	}
+	return m.tempAuthKey == nil || time.Until(m.tempKeyExpires) < tempKeyRenewBefore
+}
+
+// bindAttempts is how many times auth.bindTempAuthKey is sent when the server
+// corrects the salt or the time.
+const bindAttempts = 3
+
+// makeTempAuthKey creates a temporary key and binds it to the permanent one.
+// https://core.telegram.org/api/pfs
+func (m *MTProto) makeTempAuthKey() error {
+	authKey, serverSalt, err := m.exchangeKey(int32(m.tempKeyTTL / time.Second))
+	if err != nil {
+		return err
+	}
+
+	m.tempAuthKey = authKey
+	m.tempAuthKeyHash = sha1(authKey)[12:20]
+	m.tempKeyExpires = time.Now().Add(m.tempKeyTTL)
+	// the server keeps sessions and salts per key
+	m.serverSalt = serverSalt
+	m.futureSalts = nil
+	m.sessionId = randomLong()
+	m.lastSeqNo = 0
+
+	err = m.bindTempAuthKey(m.tempKeyTTL)
+	if err != nil {
+		m.tempAuthKey = nil
+		m.tempAuthKeyHash = nil
+		return err
+	}
+
+	return nil
+}
+
+// bindTempAuthKey binds the temporary key to the permanent one with auth.bindTempAuthKey,
+// for ttl from the server time. Nothing else may be sent with the temporary key before,
+// and the routines don't run yet, so the answer is waited for and handled here.
+func (m *MTProto) bindTempAuthKey(ttl time.Duration) error {
+	var acks []int64
+	for attempt := 0; attempt < bindAttempts; attempt++ {
+		msgId, err := m.sendBindTempAuthKey(int32(m.clock.now().Add(ttl).Unix()))
+		if err != nil {
+			return err
+		}
+		done, err := m.readBindAnswer(msgId, &acks)
+		if err != nil {
+			return err
+		}
+		if done {
+			if len(acks) == 0 {
+				return nil
+			}
+			return m.sendMessage(m.clock.newMsgId(), TL_msgs_ack{acks}, nil)
+		}
+	}
+	return fmt.Errorf("PFS: auth.bindTempAuthKey: rejected %d times", bindAttempts)
+}
+
+// sendBindTempAuthKey sends auth.bindTempAuthKey and returns its msg_id.
+func (m *MTProto) sendBindTempAuthKey(expiresAt int32) (int64, error) {
+	msgId := m.clock.newMsgId()
+	nonce := randomLong()
+	permKeyId := int64(binary.LittleEndian.Uint64(m.authKeyHash))
+	inner := TL_bind_auth_key_inner{
+		nonce,
+		int64(binary.LittleEndian.Uint64(m.tempAuthKeyHash)),
+		permKeyId,
+		m.sessionId,
+		expiresAt,
+	}.encode()
+
+	// the binding message is encrypted with the permanent key as in MTProto 1.0,
+	// with a random salt and session_id and the msg_id of the request itself
+	z := NewEncodeBuf(256)
+	z.Bytes(GenerateNonce(16))
+	z.Long(msgId)
+	z.Int(0)
+	z.Int(int32(len(inner)))
+	z.Bytes(inner)
+	msgKey, encryptedData, _, err := encryptMessage(m.authKey, z.buf, false)
+	if err != nil {
+		return 0, err
+	}
+	x := NewEncodeBuf(256)
+	x.Bytes(m.authKeyHash)
+	x.Bytes(msgKey)
+	x.Bytes(encryptedData)
+
+	err = m.sendMessage(msgId, TL_auth_bindTempAuthKey{permKeyId, nonce, expiresAt, x.buf}, nil)
+	// a binding message can't be resent with another msg_id
+	m.mutex.Lock()
+	delete(m.msgsIdToAck, msgId)
+	m.mutex.Unlock()
+	return msgId, err
+}
+
+// readBindAnswer reads until the server answers the bind request msgId. It returns false
+// if the request has to be sent again after a salt or time correction. The msg_ids
+// which need an ack are added to acks.
+func (m *MTProto) readBindAnswer(msgId int64, acks *[]int64) (bool, error) {
+	for {
+		data, err := m.read(nil)
+		if err != nil {
+			return false, err
+		}
+		msgs := []TL_MT_message{{m.msgId, m.seqNo, 0, data}}
+		if c, ok := data.(TL_msg_container); ok {
+			msgs = msgs[:0]
+			for _, v := range c.items {
+				if m.received.add(v.msg_id) {
+					msgs = append(msgs, v)
+				}
+			}
+		}
+
+		for _, v := range msgs {
+			if v.seq_no&1 == 1 {
+				*acks = append(*acks, v.msg_id)
+			}
+			switch x := v.data.(type) {
+			case TL_rpc_result:
+				if x.req_msg_id != msgId {
+					break
+				}
+				if _, ok := x.obj.(TL_boolTrue); !ok {
+					return false, fmt.Errorf("PFS: auth.bindTempAuthKey: %#v", x.obj)
+				}
+				return true, nil
+
+			case TL_bad_server_salt:
+				if x.bad_msg_id != msgId {
+					break
+				}
+				m.mutex.Lock()
+				m.serverSalt = x.new_server_salt
+				m.mutex.Unlock()
+				return false, nil
+
+			case TL_crc_bad_msg_notification:
+				if x.bad_msg_id != msgId {
+					break
+				}
+				if x.error_code != 16 && x.error_code != 17 {
+					return false, fmt.Errorf("PFS: auth.bindTempAuthKey: %v", BadMsgError{x.error_code})
+				}
+				m.clock.setServerTime(msgIdTime(v.msg_id))
+				if x.error_code == 17 {
+					m.clock.rewind()
+				}
+				return false, nil
+
+			case TL_new_session_created:
+				m.mutex.Lock()
+				restarted := m.serverInstance(x)
+				m.mutex.Unlock()
+				if restarted {
+					m.updatesGap()
+				}
+			}
+		}
+	}
+}
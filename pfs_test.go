@@ -0,0 +1,123 @@
+package mtproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBindTempAuthKey(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	m := newTestMTProto(nil)
+	m.conn = &streamConn{client, NewIntermediateTransport()}
+	m.tempAuthKey = GenerateNonce(256)
+	m.tempAuthKeyHash = sha1(m.tempAuthKey)[12:20]
+	// the local clock is an hour slow
+	serverTime := time.Now().Add(time.Hour)
+	m.clock.setServerTime(serverTime)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- m.bindTempAuthKey(time.Hour)
+	}()
+
+	readRequest := func() ([]byte, int64) {
+		x, _, err := NewIntermediateTransport().ReadPacket(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(x[:8], m.tempAuthKeyHash) {
+			t.Fatal("Request is not encrypted with the temporary key")
+		}
+		y, err := decryptServerSide(m.tempAuthKey, x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return y, int64(binary.LittleEndian.Uint64(y[16:]))
+	}
+
+	// the first request comes with a wrong salt
+	_, msgId := readRequest()
+	newSalt := GenerateNonce(8)
+	badSalt := NewEncodeBuf(64)
+	badSalt.UInt(crc_bad_server_salt)
+	badSalt.Long(msgId)
+	badSalt.Int(1)
+	badSalt.Int(48)
+	badSalt.Bytes(newSalt)
+	err := NewIntermediateTransport().WritePacket(server, serverPacketId(m, msgIdAt(m.clock.now())|1, 0, badSalt.buf), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	y, resentId := readRequest()
+	if !bytes.Equal(y[:8], newSalt) || resentId <= msgId {
+		t.Fatal("Request is not sent again with the new salt and msg_id")
+	}
+	msgId = resentId
+	d := NewDecodeBuf(y[32:])
+	if d.UInt() != crc_auth_bindTempAuthKey {
+		t.Fatal("Need auth.bindTempAuthKey")
+	}
+	permKeyId := d.Long()
+	nonce := d.Long()
+	expiresAt := d.Int()
+	encrypted := d.StringBytes()
+	if d.err != nil || permKeyId != int64(binary.LittleEndian.Uint64(m.authKeyHash)) {
+		t.Fatalf("Wrong request: %x %v", permKeyId, d.err)
+	}
+	if e := time.Unix(int64(expiresAt), 0).Sub(serverTime); e < time.Hour-5*time.Second || e > time.Hour+5*time.Second {
+		t.Errorf("Key expires %s after the server time", e)
+	}
+
+	// the binding message
+	if !bytes.Equal(encrypted[:8], m.authKeyHash) {
+		t.Fatal("Binding message is not encrypted with the permanent key")
+	}
+	y, err = decryptServerSide(m.authKey, encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint64(y[16:]) != uint64(msgId) || binary.LittleEndian.Uint32(y[24:]) != 0 {
+		t.Error("Binding message has wrong msg_id or seq_no")
+	}
+	want := TL_bind_auth_key_inner{
+		nonce,
+		int64(binary.LittleEndian.Uint64(m.tempAuthKeyHash)),
+		permKeyId,
+		m.sessionId,
+		expiresAt,
+	}.encode()
+	if !bytes.Equal(y[32:32+len(want)], want) {
+		t.Errorf("Wrong binding message %x", y[32:])
+	}
+
+	result := NewEncodeBuf(64)
+	result.UInt(crc_rpc_result)
+	result.Long(msgId)
+	result.UInt(crc_boolTrue)
+	err = NewIntermediateTransport().WritePacket(server, serverPacketId(m, msgIdAt(m.clock.now())|1, 1, result.buf), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the answer is acknowledged without the send routine
+	if y, _ = readRequest(); binary.LittleEndian.Uint32(y[32:]) != crc_msgs_ack {
+		t.Errorf("Got %x instead of msgs_ack", y[32:36])
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if len(m.msgsIdToAck) != 0 || len(m.msgsIdToResp) != 0 || len(m.queueSend) != 0 {
+		t.Error("Binding request is still tracked")
+	}
+}
+
+// decryptServerSide decrypts a MTProto 1.0 message sent by the client.
+func decryptServerSide(authKey, x []byte) ([]byte, error) {
+	aesKey, aesIV := generateAES(x[8:24], authKey, false)
+	return doAES256IGEdecrypt(x[24:], aesKey, aesIV)
+}
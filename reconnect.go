@@ -0,0 +1,239 @@
+package mtproto
+
+import (
+	"bytes"
+	"time"
+)
+
+const (
+	reconnectMinDelay = 500 * time.Millisecond
+	reconnectMaxDelay = 30 * time.Second
+
+	// backoff attempt to start from after a transport flood error (4-8 s)
+	floodAttempt = 4
+)
+
+// startRoutines launches the send, read and ping routines for the current connection.
+func (m *MTProto) startRoutines() {
+	stop := make(chan struct{})
+	m.mutex.Lock()
+	m.stop = stop
+	m.mutex.Unlock()
+	m.routines.Add(3)
+	go m.sendRoutine(stop)
+	go m.readRoutine(stop)
+	go m.pingRoutine(stop)
+}
+
+// stopRoutines closes the current connection and waits for its routines.
+// The send queue is kept, so packets queued meanwhile go out on the next connection.
+func (m *MTProto) stopRoutines() {
+	m.mutex.Lock()
+	select {
+	case <-m.stop:
+		// stopped already, reconnect and restore may both get here
+	default:
+		close(m.stop)
+	}
+	m.mutex.Unlock()
+	_ = m.conn.Close()
+	m.routines.Wait()
+}
+
+// enqueue puts a packet to the send queue unless the connection is being stopped.
+// The routines use it so that they never block a reconnect.
+func (m *MTProto) enqueue(x packetToSend) bool {
+	m.mutex.Lock()
+	stop := m.stop
+	m.mutex.Unlock()
+	select {
+	case m.queueSend <- x:
+		return true
+	case <-stop:
+		return false
+	}
+}
+
+// connectionLost is called by a routine which failed on the connection.
+func (m *MTProto) connectionLost(stop <-chan struct{}, err error) {
+	select {
+	case <-stop:
+		// the connection was closed on purpose
+		return
+	default:
+	}
+
+	m.mutex.Lock()
+	if m.reconnecting {
+		m.mutex.Unlock()
+		return
+	}
+	m.reconnecting = true
+	m.mutex.Unlock()
+
+	m.connError(err)
+	go m.restore(err)
+}
+
+// connError reports a connection error to the function set with WithConnectionErrors.
+func (m *MTProto) connError(err error) {
+	if m.onConnError != nil {
+		m.onConnError(err)
+	}
+}
+
+// restore reconnects to the same DC until it succeeds, keeping the auth key,
+// the server salt and the session where it can, so callers waiting for answers
+// are not affected.
+func (m *MTProto) restore(cause error) {
+	m.stopRoutines()
+
+	m.mutex.Lock()
+	sessionId := m.sessionId
+	m.mutex.Unlock()
+	_, keyId := m.sessionKey()
+
+	attempt := m.recoverFrom(cause, 0)
+	for ; ; attempt++ {
+		time.Sleep(backoffDelay(attempt))
+		err := m.connect()
+		if err == nil {
+			break
+		}
+		m.connError(err)
+		attempt = m.recoverFrom(err, attempt)
+	}
+
+	m.mutex.Lock()
+	m.reconnecting = false
+	m.mutex.Unlock()
+
+	if _, newKeyId := m.sessionKey(); !bytes.Equal(newKeyId, keyId) {
+		// a new key needs initConnection before any other request, so it is
+		// written before the routines start; a failed write is handled as
+		// any other lost request
+		resp := make(chan TL, 1)
+		if err := m.sendMessages([]packetToSend{m.initConnection(resp)}); err != nil {
+			m.connError(err)
+		}
+		go m.applyConfig(resp)
+	}
+
+	m.startRoutines()
+
+	m.mutex.Lock()
+	sameSession := m.sessionId == sessionId
+	m.mutex.Unlock()
+	if sameSession {
+		// the server still has the session, so ask what it got
+		m.requestStates()
+	} else {
+		m.resendPending()
+	}
+}
+
+// recoverFrom fixes the connection state after a transport error
+// and returns the backoff attempt to continue from.
+func (m *MTProto) recoverFrom(err error, attempt int) int {
+	e, ok := err.(TransportError)
+	if !ok {
+		return attempt
+	}
+
+	switch e.Code {
+	case TransportErrorAuthKeyNotFound:
+		// the server forgot the key, the next connect makes a new one
+		if m.tempAuthKey != nil {
+			m.tempAuthKey = nil
+			m.tempAuthKeyHash = nil
+		} else {
+			m.dropAuthKey()
+		}
+	case TransportErrorFlood:
+		if attempt < floodAttempt {
+			attempt = floodAttempt
+		}
+	case TransportErrorInvalidDC:
+		addrs := m.candidateAddrs()
+		if len(addrs) > 1 {
+			m.addr = addrs[1]
+		}
+	}
+
+	return attempt
+}
+
+// backoffDelay grows exponentially with the attempt number; the jitter keeps
+// many clients from reconnecting at the same moment.
+func backoffDelay(attempt int) time.Duration {
+	d := reconnectMaxDelay
+	if attempt < 16 && reconnectMinDelay<<uint(attempt) < d {
+		d = reconnectMinDelay << uint(attempt)
+	}
+	return d/2 + time.Duration(uint64(randomLong())%uint64(d/2))
+}
+
+// resend queues the message msgId again, it gets a new msg_id when sent.
+// For a container its messages are resent.
+func (m *MTProto) resend(msgId int64) {
+	m.mutex.Lock()
+	if inner, ok := m.containers[msgId]; ok {
+		delete(m.containers, msgId)
+		m.mutex.Unlock()
+		for _, id := range inner {
+			m.resend(id)
+		}
+		return
+	}
+	x, ok := m.takePending(msgId)
+	m.mutex.Unlock()
+
+	if ok && !m.enqueue(x) {
+		// the connection is lost, resendPending picks it up after the reconnect
+		m.mutex.Lock()
+		m.msgsIdToAck[msgId] = x
+		m.mutex.Unlock()
+	}
+}
+
+// resendPending queues again every message the server hasn't acknowledged
+// and every request it hasn't answered.
+func (m *MTProto) resendPending() {
+	m.mutex.Lock()
+	list := make(map[int64]packetToSend, len(m.msgsIdToAck)+len(m.msgsIdToResp))
+	for k := range m.msgsIdToAck {
+		list[k], _ = m.takePending(k)
+	}
+	for k := range m.msgsIdToResp {
+		list[k], _ = m.takePending(k)
+	}
+	// the resent messages get new quick ack tokens
+	for k := range m.quickAcks {
+		delete(m.quickAcks, k)
+	}
+	m.mutex.Unlock()
+
+	for k, v := range list {
+		if !m.enqueue(v) {
+			// the connection is lost again, keep the rest for the next attempt
+			m.mutex.Lock()
+			m.msgsIdToAck[k] = v
+			m.mutex.Unlock()
+		}
+	}
+}
+
+// takePending forgets the message msgId, which waits for an ack or an answer,
+// and returns it to be queued again. m.mutex must be held.
+func (m *MTProto) takePending(msgId int64) (packetToSend, bool) {
+	x, ok := m.msgsIdToAck[msgId]
+	if !ok {
+		x, ok = m.msgsIdToResp[msgId]
+	}
+	if ok {
+		delete(m.msgsIdToAck, msgId)
+		delete(m.msgsIdToResp, msgId)
+		m.setStatus(x.resp, StatusQueued)
+	}
+	return x, ok
+}
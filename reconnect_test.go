@@ -0,0 +1,274 @@
+package mtproto
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	for attempt := 0; attempt < 100; attempt++ {
+		d := backoffDelay(attempt)
+		if d < reconnectMinDelay/2 || d > reconnectMaxDelay {
+			t.Fatalf("Attempt %d: delay %s", attempt, d)
+		}
+	}
+}
+
+// newTestMTProto returns an instance with a random auth key which dials with dial.
+func newTestMTProto(dial DialContextFunc) *MTProto {
+	m := &MTProto{
+		addr:         "149.154.167.50:443",
+		dcId:         2,
+		newTransport: NewAbridgedTransport,
+		dial:         dial,
+		dcs:          newDcTable(),
+		rsaKeys:      newRSAKeys(),
+		authKey:      GenerateNonce(256),
+		serverSalt:   GenerateNonce(8),
+		encrypted:    true,
+	}
+	m.initQueues()
+	m.authKeyHash = sha1(m.authKey)[12:20]
+	return m
+}
+
+func TestStopRoutinesTwice(t *testing.T) {
+	m := newTestMTProto(nil)
+	client, server := net.Pipe()
+	defer server.Close()
+	m.conn = &streamConn{client, NewAbridgedTransport()}
+	m.startRoutines()
+	m.stopRoutines()
+	m.stopRoutines()
+}
+
+func TestReconnectResendsUnacked(t *testing.T) {
+	var mutex sync.Mutex
+	dials := 0
+	servers := make(chan net.Conn, 4)
+	m := newTestMTProto(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		dials++
+		if dials == 2 || dials == 3 {
+			return nil, errors.New("network is unreachable")
+		}
+		client, server := net.Pipe()
+		servers <- server
+		return client, nil
+	})
+
+	connErrors := make(chan error, 4)
+	m.onConnError = func(err error) { connErrors <- err }
+
+	// a request sent before the connection broke
+	resp := make(chan TL, 1)
+	m.msgsIdToAck[1] = packetToSend{TL_ping{1}, resp}
+	m.msgsIdToResp[1] = m.msgsIdToAck[1]
+
+	go func() {
+		server := <-servers
+		io.ReadFull(server, make([]byte, 1))
+		server.Close()
+	}()
+	if err := m.connect(); err != nil {
+		t.Fatal(err)
+	}
+	m.startRoutines()
+
+	var server net.Conn
+	select {
+	case server = <-servers:
+	case <-time.After(10 * time.Second):
+		t.Fatal("No reconnect")
+	}
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// the abridged marker and the state request for the unacknowledged message
+	if _, err := io.ReadFull(server, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	x, _, err := NewAbridgedTransport().ReadPacket(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, err := decryptServerSide(m.authKey, x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(y[32:]) != crc_msgs_state_req {
+		t.Fatalf("Got %x instead of msgs_state_req", y[32:])
+	}
+
+	// the server hasn't received it, so it is resent
+	info := NewEncodeBuf(32)
+	info.UInt(crc_msgs_state_info)
+	info.Long(int64(binary.LittleEndian.Uint64(y[16:])))
+	info.StringBytes([]byte{msgStateNotReceived})
+	if err = NewAbridgedTransport().WritePacket(server, serverPacket(m, 0, info.buf), false); err != nil {
+		t.Fatal(err)
+	}
+	if x, _, err = NewAbridgedTransport().ReadPacket(server); err != nil {
+		t.Fatal(err)
+	}
+	if y, err = decryptServerSide(m.authKey, x); err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint32(y[32:]) != crc_ping {
+		t.Fatalf("Got %x instead of the resent ping", y[32:])
+	}
+
+	m.mutex.Lock()
+	_, stale := m.msgsIdToAck[1]
+	pending := len(m.msgsIdToResp)
+	m.mutex.Unlock()
+	if stale || pending != 1 {
+		t.Errorf("Resent request is not tracked under its new msg_id")
+	}
+	// the lost connection and the two failed dials
+	if len(connErrors) != 3 {
+		t.Errorf("%d connection errors reported", len(connErrors))
+	}
+
+	m.stopRoutines()
+}
+
+func TestReconnectAuthKeyNotFound(t *testing.T) {
+	f, err := ioutil.TempFile("", "mtproto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	f.Write([]byte("saved auth key"))
+
+	servers := make(chan net.Conn, 4)
+	m := newTestMTProto(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		client, server := net.Pipe()
+		servers <- server
+		return client, nil
+	})
+	m.f = f
+
+	go func() {
+		server := <-servers
+		io.ReadFull(server, make([]byte, 1))
+		NewAbridgedTransport().WritePacket(server, []byte{0x6c, 0xfe, 0xff, 0xff}, false)
+	}()
+	if err = m.connect(); err != nil {
+		t.Fatal(err)
+	}
+	m.startRoutines()
+
+	var server net.Conn
+	select {
+	case server = <-servers:
+	case <-time.After(10 * time.Second):
+		t.Fatal("No reconnect")
+	}
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// a new key is negotiated
+	if _, err = io.ReadFull(server, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	x, _, err := NewAbridgedTransport().ReadPacket(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.LittleEndian.Uint64(x) != 0 || binary.LittleEndian.Uint32(x[20:]) != crc_req_pq {
+		t.Errorf("Got %x instead of req_pq", x)
+	}
+	if fi, _ := f.Stat(); fi.Size() != 0 {
+		t.Error("Auth key is not removed from the file")
+	}
+}
+
+func TestReconnectNewKey(t *testing.T) {
+	servers := make(chan net.Conn, 4)
+	dials := 0
+	var m *MTProto
+	m = newTestMTProto(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		if dials == 2 {
+			// the temporary key is rotated along with the session
+			m.tempAuthKey = GenerateNonce(256)
+			m.tempAuthKeyHash = sha1(m.tempAuthKey)[12:20]
+			m.sessionId = 2
+		}
+		client, server := net.Pipe()
+		servers <- server
+		return client, nil
+	})
+	m.sessionId = 1
+
+	// a request acknowledged but not answered in the old session
+	resp := make(chan TL, 1)
+	m.msgsIdToResp[1] = packetToSend{TL_ping{1}, resp}
+
+	go func() {
+		server := <-servers
+		io.ReadFull(server, make([]byte, 1))
+		server.Close()
+	}()
+	if err := m.connect(); err != nil {
+		t.Fatal(err)
+	}
+	m.startRoutines()
+	defer m.stopRoutines()
+
+	var server net.Conn
+	select {
+	case server = <-servers:
+	case <-time.After(10 * time.Second):
+		t.Fatal("No reconnect")
+	}
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.ReadFull(server, make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	var bodies [][]byte
+	for len(bodies) < 2 {
+		x, _, err := NewAbridgedTransport().ReadPacket(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		y, err := decryptServerSide(m.tempAuthKey, x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, y[32:])
+	}
+	if binary.LittleEndian.Uint32(bodies[0]) != crc_invokeWithLayer {
+		t.Errorf("Got %x instead of initConnection", bodies[0][:4])
+	}
+	// the ping may share a container with the routine requests
+	if !bytes.Contains(bodies[1], TL_ping{1}.encode()) {
+		t.Error("Unanswered request is not resent")
+	}
+}
+
+func TestTransportError(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	m := &MTProto{conn: &streamConn{client, NewIntermediateTransport()}}
+
+	go NewIntermediateTransport().WritePacket(server, []byte{0x53, 0xfe, 0xff, 0xff}, false)
+	_, err := m.read(nil)
+	if e, ok := err.(TransportError); !ok || e.Code != TransportErrorFlood {
+		t.Errorf("Got %v", err)
+	}
+}
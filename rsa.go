@@ -0,0 +1,126 @@
+package mtproto
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// rsaKey is a server key for the first messages of the key exchange.
+type rsaKey struct {
+	key *rsa.PublicKey
+	// the key is used with RSA_PAD instead of the old SHA1 + data + padding scheme
+	pad bool
+}
+
+// rsaKeys maps the fingerprints of the known server keys to the keys.
+type rsaKeys map[uint64]rsaKey
+
+// newRSAKeys returns the registry with the built-in Telegram key.
+func newRSAKeys() rsaKeys {
+	return rsaKeys{RSAFingerprint(&telegramPublicKey): {&telegramPublicKey, false}}
+}
+
+// addPEM adds every RSA public key found in data, in PKCS #1 or PKIX form.
+func (r rsaKeys) addPEM(data []byte, pad bool) error {
+	found := false
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var key *rsa.PublicKey
+		switch block.Type {
+		case "RSA PUBLIC KEY":
+			k, err := x509.ParsePKCS1PublicKey(block.Bytes)
+			if err != nil {
+				return err
+			}
+			key = k
+		case "PUBLIC KEY":
+			k, err := x509.ParsePKIXPublicKey(block.Bytes)
+			if err != nil {
+				return err
+			}
+			rsaKey, ok := k.(*rsa.PublicKey)
+			if !ok {
+				return fmt.Errorf("RSA: %T is not an RSA key", k)
+			}
+			key = rsaKey
+		default:
+			continue
+		}
+		if key.N.BitLen() != 2048 {
+			return fmt.Errorf("RSA: key is %d bits long, need 2048", key.N.BitLen())
+		}
+		r[RSAFingerprint(key)] = rsaKey{key, pad}
+		found = true
+	}
+
+	if !found {
+		return errors.New("RSA: no public key found")
+	}
+	return nil
+}
+
+// find returns the first key of the server fingerprints which is known.
+func (r rsaKeys) find(fingerprints []int64) (uint64, rsaKey, bool) {
+	for _, fp := range fingerprints {
+		if k, ok := r[uint64(fp)]; ok {
+			return uint64(fp), k, true
+		}
+	}
+	return 0, rsaKey{}, false
+}
+
+// RSAFingerprint returns the fingerprint the server uses for key in resPQ:
+// the lower 64 bits of SHA1 of the TL-serialized modulus and exponent.
+func RSAFingerprint(key *rsa.PublicKey) uint64 {
+	x := NewEncodeBuf(512)
+	x.StringBytes(key.N.Bytes())
+	x.StringBytes(big.NewInt(int64(key.E)).Bytes())
+	return binary.LittleEndian.Uint64(sha1(x.buf)[12:20])
+}
+
+// rsaPadEncrypt encrypts data of up to 144 bytes with the RSA_PAD scheme.
+// https://core.telegram.org/mtproto/auth_key#presenting-proof-of-work-server-authentication
+func rsaPadEncrypt(key *rsa.PublicKey, data []byte) ([]byte, error) {
+	if len(data) > 144 {
+		return nil, fmt.Errorf("RSA_PAD: data is %d bytes long", len(data))
+	}
+
+	dataWithPadding := make([]byte, 192)
+	copy(dataWithPadding, data)
+	copy(dataWithPadding[len(data):], GenerateNonce(192-len(data)))
+	dataWithHash := make([]byte, 192, 224)
+	for i, b := range dataWithPadding {
+		dataWithHash[191-i] = b
+	}
+
+	for {
+		tempKey := GenerateNonce(32)
+		x := append(dataWithHash, sha256Sum(tempKey, dataWithPadding)...)
+		aesEncrypted, err := doAES256IGEencrypt(x, tempKey, make([]byte, 32))
+		if err != nil {
+			return nil, err
+		}
+		tempKeyXor := sha256Sum(aesEncrypted)
+		xor(tempKeyXor, tempKey)
+
+		keyAESEncrypted := new(big.Int).SetBytes(append(tempKeyXor, aesEncrypted...))
+		if keyAESEncrypted.Cmp(key.N) >= 0 {
+			continue
+		}
+
+		c := new(big.Int).Exp(keyAESEncrypted, big.NewInt(int64(key.E)), key.N)
+		res := make([]byte, 256)
+		c.FillBytes(res)
+		return res, nil
+	}
+}
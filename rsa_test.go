@@ -0,0 +1,94 @@
+package mtproto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"testing"
+)
+
+func TestRSAFingerprint(t *testing.T) {
+	if fp := RSAFingerprint(&telegramPublicKey); fp != telegramPublicKey_FP {
+		t.Errorf("Fingerprint %d", fp)
+	}
+}
+
+func TestRSAKeys(t *testing.T) {
+	key1, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(&key2.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key1.PublicKey)})...)
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkix})...)
+
+	keys := newRSAKeys()
+	if err = keys.addPEM(data, true); err != nil {
+		t.Fatal(err)
+	}
+	if err = keys.addPEM([]byte("no keys here"), true); err == nil {
+		t.Error("Empty PEM accepted")
+	}
+
+	fp1, fp2 := RSAFingerprint(&key1.PublicKey), RSAFingerprint(&key2.PublicKey)
+	fp, k, ok := keys.find([]int64{12345, int64(fp2), int64(fp1)})
+	if !ok || fp != fp2 || k.key.N.Cmp(key2.N) != 0 || !k.pad {
+		t.Error("Wrong key found")
+	}
+	builtIn := uint64(telegramPublicKey_FP)
+	fp, k, ok = keys.find([]int64{int64(builtIn)})
+	if !ok || fp != telegramPublicKey_FP || k.pad {
+		t.Error("Built-in key not found")
+	}
+	if _, _, ok = keys.find([]int64{12345}); ok {
+		t.Error("Unknown key found")
+	}
+}
+
+func TestRSAPadEncrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := GenerateNonce(100)
+	x, err := rsaPadEncrypt(&key.PublicKey, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// decrypt it the way the server does
+	keyAESEncrypted := make([]byte, 256)
+	new(big.Int).Exp(new(big.Int).SetBytes(x), key.D, key.N).FillBytes(keyAESEncrypted)
+	aesEncrypted := keyAESEncrypted[32:]
+	tempKey := sha256Sum(aesEncrypted)
+	xor(tempKey, keyAESEncrypted[:32])
+	dataWithHash, err := doAES256IGEdecrypt(aesEncrypted, tempKey, make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataWithPadding := make([]byte, 192)
+	for i := range dataWithPadding {
+		dataWithPadding[i] = dataWithHash[191-i]
+	}
+	if !bytes.Equal(sha256Sum(tempKey, dataWithPadding), dataWithHash[192:]) {
+		t.Error("Wrong hash")
+	}
+	if !bytes.Equal(dataWithPadding[:len(data)], data) {
+		t.Error("Wrong data")
+	}
+
+	if _, err = rsaPadEncrypt(&key.PublicKey, GenerateNonce(145)); err == nil {
+		t.Error("Too long data accepted")
+	}
+}
@@ -0,0 +1,71 @@
+package mtproto
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// salts asked for with get_future_salts, each one is valid for about an hour
+	futureSaltsNum = 32
+	// new salts are asked for when the known ones run out sooner than this
+	futureSaltsAhead = 2 * time.Hour
+	// get_future_salts is not repeated more often than this
+	futureSaltsRetry = 10 * time.Minute
+)
+
+// futureSalt is a server salt with its validity window in server time.
+// https://core.telegram.org/mtproto/service_messages#request-for-several-future-salts
+type futureSalt struct {
+	validSince time.Time
+	validUntil time.Time
+	salt       []byte
+}
+
+// setFutureSalts stores the salts answered to get_future_salts and switches to the current one.
+func (m *MTProto) setFutureSalts(data TL_future_salts) {
+	salts := make([]futureSalt, 0, len(data.salts))
+	for _, v := range data.salts {
+		salts = append(salts, futureSalt{
+			time.Unix(int64(v.valid_since), 0),
+			time.Unix(int64(v.valid_until), 0),
+			v.salt,
+		})
+	}
+	sort.Slice(salts, func(i, j int) bool {
+		return salts[i].validSince.Before(salts[j].validSince)
+	})
+
+	m.mutex.Lock()
+	m.futureSalts = salts
+	m.rotateSalt()
+	m.mutex.Unlock()
+}
+
+// rotateSalt forgets the expired future salts and makes the oldest valid one the server salt.
+// m.mutex must be held.
+func (m *MTProto) rotateSalt() {
+	now := m.clock.now()
+	for len(m.futureSalts) > 0 && !now.Before(m.futureSalts[0].validUntil) {
+		m.futureSalts = m.futureSalts[1:]
+	}
+	if len(m.futureSalts) > 0 && !now.Before(m.futureSalts[0].validSince) {
+		m.serverSalt = m.futureSalts[0].salt
+	}
+}
+
+// needFutureSalts tells whether the ping routine has to ask for new salts.
+func (m *MTProto) needFutureSalts() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if time.Since(m.saltsRequested) < futureSaltsRetry {
+		return false
+	}
+	n := len(m.futureSalts)
+	if n > 0 && m.futureSalts[n-1].validUntil.Sub(m.clock.now()) > futureSaltsAhead {
+		return false
+	}
+	m.saltsRequested = time.Now()
+	return true
+}
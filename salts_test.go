@@ -0,0 +1,58 @@
+package mtproto
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestFutureSalts(t *testing.T) {
+	m := newTestMTProto(nil)
+	now := int32(time.Now().Unix())
+	b := NewEncodeBuf(128)
+	b.UInt(crc_future_salts)
+	b.Long(100)
+	b.Int(now)
+	b.Int(3)
+	for i, salt := range [][]byte{
+		{1, 1, 1, 1, 1, 1, 1, 1},
+		{2, 2, 2, 2, 2, 2, 2, 2},
+		{3, 3, 3, 3, 3, 3, 3, 3},
+	} {
+		// the first one has expired already
+		b.Int(now + int32(i-1)*3600 - 60)
+		b.Int(now + int32(i)*3600 - 60)
+		b.Bytes(salt)
+	}
+
+	data, ok := NewDecodeBuf(b.buf).Object().(TL_future_salts)
+	if !ok || len(data.salts) != 3 {
+		t.Fatalf("Decoded %#v", data)
+	}
+	m.process(GenerateMessageId(), 0, data)
+
+	if !bytes.Equal(m.serverSalt, []byte{2, 2, 2, 2, 2, 2, 2, 2}) {
+		t.Errorf("Server salt %x", m.serverSalt)
+	}
+	if len(m.futureSalts) != 2 {
+		t.Errorf("%d future salts kept", len(m.futureSalts))
+	}
+	if !m.needFutureSalts() {
+		t.Error("Salts which run out in an hour are not renewed")
+	}
+	if m.needFutureSalts() {
+		t.Error("Salts asked for twice")
+	}
+}
+
+func TestFutureSaltsWrongSize(t *testing.T) {
+	b := NewEncodeBuf(32)
+	b.UInt(crc_future_salts)
+	b.Long(100)
+	b.Int(0)
+	b.Int(1 << 30)
+	d := NewDecodeBuf(b.buf)
+	if x := d.Object(); x != nil || d.err == nil {
+		t.Errorf("Decoded %#v", x)
+	}
+}
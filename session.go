@@ -0,0 +1,61 @@
+package mtproto
+
+// newSession starts a new session; the old one is destroyed on the server.
+func (m *MTProto) newSession() {
+	m.mutex.Lock()
+	m.staleSessions = append(m.staleSessions, m.sessionId)
+	m.sessionId = randomLong()
+	m.lastSeqNo = 0
+	m.mutex.Unlock()
+}
+
+// sessionCreated handles new_session_created: the server has no state of the session
+// before first_msg_id, and a new unique_id means it was restarted and updates may be lost.
+// https://core.telegram.org/mtproto/service_messages#new-session-creation-notification
+func (m *MTProto) sessionCreated(data TL_new_session_created) {
+	m.mutex.Lock()
+	restarted := m.serverInstance(data)
+	var lost []int64
+	for id := range m.msgsIdToAck {
+		if id < data.first_msg_id {
+			lost = append(lost, id)
+		}
+	}
+	// acknowledged requests are lost as well if the answer didn't come yet
+	for id := range m.msgsIdToResp {
+		if _, ok := m.msgsIdToAck[id]; !ok && id < data.first_msg_id {
+			lost = append(lost, id)
+		}
+	}
+	m.mutex.Unlock()
+	_ = m.saveData()
+
+	for _, id := range lost {
+		m.resend(id)
+	}
+	if restarted {
+		m.updatesGap()
+	}
+}
+
+// serverInstance takes the salt and the unique_id of new_session_created
+// and tells whether the server was restarted. m.mutex must be held.
+func (m *MTProto) serverInstance(data TL_new_session_created) bool {
+	m.serverSalt = data.server_salt
+	restarted := m.serverUniqueId != 0 && m.serverUniqueId != data.unique_id
+	m.serverUniqueId = data.unique_id
+	return restarted
+}
+
+// destroyStaleSessions asks the server to forget the sessions this client left behind.
+// The answers, destroy_session_ok or destroy_session_none, need no handling.
+func (m *MTProto) destroyStaleSessions() {
+	m.mutex.Lock()
+	stale := m.staleSessions
+	m.staleSessions = nil
+	m.mutex.Unlock()
+
+	for _, id := range stale {
+		m.enqueue(packetToSend{TL_destroy_session{id}, nil})
+	}
+}
@@ -0,0 +1,82 @@
+package mtproto
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSessionCreated(t *testing.T) {
+	f, err := ioutil.TempFile("", "mtproto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	m := newTestMTProto(nil)
+	m.f = f
+	gaps := make(chan struct{}, 2)
+	m.onUpdatesGap = func() { gaps <- struct{}{} }
+
+	m.msgsIdToAck[4] = packetToSend{TL_help_getConfig{}, nil}
+	m.msgsIdToAck[100] = packetToSend{TL_help_getConfig{}, nil}
+	// acknowledged, but not answered
+	m.msgsIdToResp[8] = packetToSend{TL_help_getConfig{}, make(chan TL, 1)}
+	m.process(GenerateMessageId()|1, 0, TL_new_session_created{50, 7, GenerateNonce(8)})
+
+	if _, ok := m.msgsIdToAck[4]; ok || len(m.queueSend) != 2 {
+		t.Error("Message sent before the session was created is not resent")
+	}
+	if _, ok := m.msgsIdToResp[8]; ok {
+		t.Error("Unanswered request sent before the session was created is not resent")
+	}
+	if _, ok := m.msgsIdToAck[100]; !ok {
+		t.Error("Message of the new session is resent")
+	}
+
+	// the same server instance, then a restarted one
+	m.process(GenerateMessageId()|1, 0, TL_new_session_created{200, 7, GenerateNonce(8)})
+	m.process(GenerateMessageId()|1, 0, TL_new_session_created{300, 8, GenerateNonce(8)})
+	select {
+	case <-gaps:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Updates gap is not reported")
+	}
+	select {
+	case <-gaps:
+		t.Error("Updates gap reported twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestDestroyStaleSessions(t *testing.T) {
+	f, err := ioutil.TempFile("", "mtproto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	m := newTestMTProto(nil)
+	m.f = f
+	m.sessionId = 12345
+	if err = m.saveData(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the next start destroys the session of this one
+	next := newTestMTProto(nil)
+	next.f = f
+	if err = next.readData(); err != nil {
+		t.Fatal(err)
+	}
+	replaced := next.sessionId
+	next.newSession()
+	next.destroyStaleSessions()
+	for _, want := range []int64{12345, replaced} {
+		if x, ok := (<-next.queueSend).msg.(TL_destroy_session); !ok || x.session_id != want {
+			t.Errorf("Queued %#v instead of destroying %d", x, want)
+		}
+	}
+	if len(next.staleSessions) != 0 {
+		t.Error("Stale sessions are kept")
+	}
+}
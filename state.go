@@ -0,0 +1,103 @@
+package mtproto
+
+import "sort"
+
+// states of a message in msgs_state_info, the lower 3 bits of its byte
+// https://core.telegram.org/mtproto/service_messages_about_messages#request-for-message-status-information
+const (
+	msgStateUnknown     = 1 // msg_id too low, the server may have forgotten it
+	msgStateNotReceived = 2
+	msgStateTooHigh     = 3 // msg_id too high, not received yet
+	msgStateReceived    = 4
+
+	// flags
+	msgStateAnswered = 64 // the answer is made already
+)
+
+// requestStates asks the server about every message it hasn't acknowledged or answered,
+// so that after a reconnect to the same session only the lost ones are resent.
+func (m *MTProto) requestStates() {
+	m.mutex.Lock()
+	ids := make([]int64, 0, len(m.msgsIdToAck))
+	for k := range m.msgsIdToAck {
+		ids = append(ids, k)
+	}
+	for k := range m.msgsIdToResp {
+		if _, ok := m.msgsIdToAck[k]; !ok {
+			ids = append(ids, k)
+		}
+	}
+	// requests made on the previous connection are not answered anymore
+	m.stateReqs = make(map[int64][]int64)
+	m.mutex.Unlock()
+
+	if len(ids) == 0 {
+		return
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	m.enqueue(packetToSend{TL_msgs_state_req{ids}, nil})
+}
+
+// applyStates resends the messages the server doesn't have and asks again for the answers
+// it made already. info has a byte for every msg_id in ids.
+func (m *MTProto) applyStates(ids []int64, info []byte) {
+	var resend, answers []int64
+
+	m.mutex.Lock()
+	for i, id := range ids {
+		if i >= len(info) {
+			break
+		}
+		x, sent := m.msgsIdToAck[id]
+		_, waiting := m.msgsIdToResp[id]
+		switch info[i] & 7 {
+		case msgStateUnknown, msgStateNotReceived, msgStateTooHigh:
+			if sent || waiting {
+				resend = append(resend, id)
+			}
+		case msgStateReceived:
+			if sent {
+				delete(m.msgsIdToAck, id)
+				m.setStatus(x.resp, StatusAcked)
+			}
+			if waiting && info[i]&msgStateAnswered != 0 {
+				answers = append(answers, id)
+			}
+		}
+	}
+	m.mutex.Unlock()
+
+	for _, id := range resend {
+		m.resend(id)
+	}
+	if len(answers) > 0 {
+		m.enqueue(packetToSend{TL_msg_resend_ans_req{answers}, nil})
+	}
+}
+
+// newDetailedInfo handles msg_new_detailed_info: answerMsgId is asked for unless it arrived already.
+func (m *MTProto) newDetailedInfo(answerMsgId int64) {
+	if m.received.has(answerMsgId) {
+		m.enqueue(packetToSend{TL_msgs_ack{[]int64{answerMsgId}}, nil})
+	} else {
+		m.enqueue(packetToSend{TL_msg_resend_req{[]int64{answerMsgId}}, nil})
+	}
+}
+
+// detailedInfo handles msg_detailed_info: the request msgId is answered with answerMsgId,
+// which the server doesn't send by itself when the answer is large.
+func (m *MTProto) detailedInfo(msgId, answerMsgId int64) {
+	m.mutex.Lock()
+	if x, ok := m.msgsIdToAck[msgId]; ok {
+		delete(m.msgsIdToAck, msgId)
+		m.setStatus(x.resp, StatusAcked)
+	}
+	_, waiting := m.msgsIdToResp[msgId]
+	m.mutex.Unlock()
+
+	if waiting {
+		m.enqueue(packetToSend{TL_msg_resend_req{[]int64{answerMsgId}}, nil})
+	} else {
+		m.enqueue(packetToSend{TL_msgs_ack{[]int64{answerMsgId}}, nil})
+	}
+}
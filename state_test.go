@@ -0,0 +1,68 @@
+package mtproto
+
+import "testing"
+
+func TestApplyStates(t *testing.T) {
+	m := newTestMTProto(nil)
+	for id := int64(4); id <= 12; id += 4 {
+		resp := make(chan TL, 1)
+		m.msgsIdToAck[id] = packetToSend{TL_help_getConfig{}, resp}
+		m.msgsIdToResp[id] = m.msgsIdToAck[id]
+	}
+
+	lost := m.msgsIdToResp[4]
+	m.applyStates([]int64{4, 8, 12}, []byte{
+		msgStateNotReceived,
+		msgStateReceived | 8,
+		msgStateReceived | 32 | msgStateAnswered,
+	})
+
+	if len(m.msgsIdToAck) != 0 {
+		t.Errorf("%d messages still wait for an ack", len(m.msgsIdToAck))
+	}
+	if _, ok := m.msgsIdToResp[8]; !ok {
+		t.Error("Received request doesn't wait for its answer")
+	}
+	if x := <-m.queueSend; x.resp != lost.resp {
+		t.Errorf("Queued %#v instead of the lost request", x.msg)
+	}
+	if x, ok := (<-m.queueSend).msg.(TL_msg_resend_ans_req); !ok || len(x.msg_ids) != 1 || x.msg_ids[0] != 12 {
+		t.Errorf("Queued %#v instead of msg_resend_ans_req", x)
+	}
+}
+
+func TestDetailedInfo(t *testing.T) {
+	m := newTestMTProto(nil)
+	resp := make(chan TL, 1)
+	m.msgsIdToAck[4] = packetToSend{TL_help_getConfig{}, resp}
+	m.msgsIdToResp[4] = m.msgsIdToAck[4]
+
+	m.process(GenerateMessageId()|1, 0, TL_msg_detailed_info{4, 101, 1 << 20, 0})
+	if x, ok := (<-m.queueSend).msg.(TL_msg_resend_req); !ok || x.msg_ids[0] != 101 {
+		t.Errorf("Queued %#v instead of msg_resend_req", x)
+	}
+	if _, ok := m.msgsIdToAck[4]; ok {
+		t.Error("Request is not acknowledged")
+	}
+
+	// the answer arrived already
+	delete(m.msgsIdToResp, 4)
+	m.process(GenerateMessageId()|1, 0, TL_msg_detailed_info{4, 105, 1 << 20, 0})
+	if x, ok := (<-m.queueSend).msg.(TL_msgs_ack); !ok || x.msgIds[0] != 105 {
+		t.Errorf("Queued %#v instead of msgs_ack", x)
+	}
+}
+
+func TestNewDetailedInfo(t *testing.T) {
+	m := newTestMTProto(nil)
+	m.received.add(101)
+
+	m.process(GenerateMessageId()|1, 0, TL_msg_new_detailed_info{101, 1 << 20, 0})
+	if x, ok := (<-m.queueSend).msg.(TL_msgs_ack); !ok || x.msgIds[0] != 101 {
+		t.Errorf("Queued %#v instead of msgs_ack", x)
+	}
+	m.process(GenerateMessageId()|1, 0, TL_msg_new_detailed_info{105, 1 << 20, 0})
+	if x, ok := (<-m.queueSend).msg.(TL_msg_resend_req); !ok || x.msg_ids[0] != 105 {
+		t.Errorf("Queued %#v instead of msg_resend_req", x)
+	}
+}
@@ -0,0 +1,109 @@
+package mtproto
+
+import "fmt"
+
+// DeliveryStatus is the progress of an outgoing request.
+type DeliveryStatus int
+
+const (
+	// the request waits in the send queue
+	StatusQueued DeliveryStatus = iota
+	// the request is written to the connection
+	StatusWritten
+	// the server confirmed the receipt with a quick ack
+	StatusQuickAcked
+	// the server acknowledged the request with msgs_ack
+	StatusAcked
+	// the answer arrived, this status is the last one
+	StatusAnswered
+)
+
+func (s DeliveryStatus) String() string {
+	switch s {
+	case StatusQueued:
+		return "queued"
+	case StatusWritten:
+		return "written"
+	case StatusQuickAcked:
+		return "quick-acked"
+	case StatusAcked:
+		return "acked"
+	case StatusAnswered:
+		return "answered"
+	}
+	return fmt.Sprintf("DeliveryStatus(%d)", int(s))
+}
+
+// Request is an RPC call sent with Send.
+type Request struct {
+	// Status receives the changes of the delivery status in the order they happen.
+	// After a reconnect the unacknowledged requests start over from StatusQueued.
+	// The channel is buffered and the session never blocks on it, so changes are
+	// dropped while the buffer is full; Answer tells reliably when the call is done.
+	Status <-chan DeliveryStatus
+	// Answer receives the result of the call and is closed then.
+	Answer <-chan TL
+}
+
+// Send queues msg and returns without waiting for the answer.
+func (m *MTProto) Send(msg TL) *Request {
+	resp := make(chan TL, 1)
+	status := make(chan DeliveryStatus, 16)
+
+	m.mutex.Lock()
+	m.respToStatus[resp] = status
+	m.setStatus(resp, StatusQueued)
+	m.mutex.Unlock()
+
+	m.queueSend <- packetToSend{msg, resp}
+
+	return &Request{status, resp}
+}
+
+// setStatus reports the delivery status of the request answered to resp,
+// if the request is followed. m.mutex must be held.
+func (m *MTProto) setStatus(resp chan TL, s DeliveryStatus) {
+	status, ok := m.respToStatus[resp]
+	if !ok {
+		return
+	}
+	select {
+	case status <- s:
+	default:
+	}
+
+	if s == StatusAnswered {
+		m.forgetStatus(resp)
+	}
+}
+
+// forgetStatus stops following the request answered to resp. m.mutex must be held.
+func (m *MTProto) forgetStatus(resp chan TL) {
+	delete(m.respToStatus, resp)
+	for k, v := range m.quickAcks {
+		for i := range v {
+			if v[i] == resp {
+				v = append(v[:i:i], v[i+1:]...)
+				break
+			}
+		}
+		if len(v) == 0 {
+			delete(m.quickAcks, k)
+		} else {
+			m.quickAcks[k] = v
+		}
+	}
+}
+
+// quickAcked handles a quick ack token read from the connection.
+func (m *MTProto) quickAcked(token uint32) {
+	m.mutex.Lock()
+	resps, ok := m.quickAcks[token]
+	if ok {
+		delete(m.quickAcks, token)
+		for _, resp := range resps {
+			m.setStatus(resp, StatusQuickAcked)
+		}
+	}
+	m.mutex.Unlock()
+}
@@ -0,0 +1,123 @@
+package mtproto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serverPacket encrypts obj the way the server sends it to m.
+func serverPacket(m *MTProto, seqNo int32, obj []byte) []byte {
+	return serverPacketId(m, GenerateMessageId()|1, seqNo, obj)
+}
+
+// serverPacketId is serverPacket with the given msg_id.
+func serverPacketId(m *MTProto, msgId int64, seqNo int32, obj []byte) []byte {
+	z := NewEncodeBuf(256)
+	z.Bytes(m.serverSalt)
+	z.Long(m.sessionId)
+	z.Long(msgId)
+	z.Int(seqNo)
+	z.Int(int32(len(obj)))
+	z.Bytes(obj)
+
+	authKey, authKeyHash := m.sessionKey()
+	var msgKey, aesKey, aesIV, y []byte
+	if m.mtproto2 {
+		y = append(z.buf, GenerateNonce(12+(16-(len(z.buf)+12)%16)%16)...)
+		msgKey = sha256Sum(authKey[96:96+32], y)[8:24]
+		aesKey, aesIV = generateAES2(msgKey, authKey, true)
+	} else {
+		msgKey = sha1(z.buf)[4:20]
+		aesKey, aesIV = generateAES(msgKey, authKey, true)
+		y = make([]byte, len(z.buf)+((16-(len(z.buf)%16))&15))
+		copy(y, z.buf)
+	}
+	encryptedData, _ := doAES256IGEencrypt(y, aesKey, aesIV)
+
+	x := NewEncodeBuf(256)
+	x.Bytes(authKeyHash)
+	x.Bytes(msgKey)
+	x.Bytes(encryptedData)
+	return x.buf
+}
+
+func TestDeliveryStatus(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	m := newTestMTProto(nil)
+	m.conn = &streamConn{client, NewIntermediateTransport()}
+	m.startRoutines()
+	defer m.stopRoutines()
+
+	req := m.Send(TL_help_getConfig{})
+	next := func(want DeliveryStatus) {
+		select {
+		case s := <-req.Status:
+			if s != want {
+				t.Fatalf("Status %s instead of %s", s, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No status %s", want)
+		}
+	}
+	next(StatusQueued)
+
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(server, b); err != nil {
+		t.Fatal(err)
+	}
+	size := binary.LittleEndian.Uint32(b)
+	if size&0x80000000 == 0 {
+		t.Fatal("No quick ack flag")
+	}
+	x := make([]byte, size&^0x80000000)
+	if _, err := io.ReadFull(server, x); err != nil {
+		t.Fatal(err)
+	}
+	next(StatusWritten)
+
+	y, err := decryptServerSide(m.authKey, x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgId := int64(binary.LittleEndian.Uint64(y[16:]))
+	token := binary.LittleEndian.Uint32(sha1(y[:32+binary.LittleEndian.Uint32(y[28:])])) | 0x80000000
+
+	binary.LittleEndian.PutUint32(b, token)
+	if _, err = server.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	next(StatusQuickAcked)
+
+	err = NewIntermediateTransport().WritePacket(server, serverPacket(m, 0, TL_msgs_ack{[]int64{msgId}}.encode()), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next(StatusAcked)
+
+	result := NewEncodeBuf(64)
+	result.UInt(crc_rpc_result)
+	result.Long(msgId)
+	result.UInt(crc_rpc_error)
+	result.Int(420)
+	result.String("FLOOD_WAIT_1")
+	go io.Copy(io.Discard, server)
+	err = NewIntermediateTransport().WritePacket(server, serverPacket(m, 1, result.buf), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next(StatusAnswered)
+	if x, ok := (<-req.Answer).(TL_rpc_error); !ok || x.error_code != 420 {
+		t.Errorf("Answer %#v", x)
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.respToStatus) != 0 || len(m.quickAcks) != 0 {
+		t.Error("Answered request is still followed")
+	}
+}
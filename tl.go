@@ -31,6 +31,41 @@ type TL_p_q_inner_data struct {
 	server_nonce []byte
 	new_nonce    []byte
 }
+type TL_p_q_inner_data_temp struct {
+	pq           *big.Int
+	p            *big.Int
+	q            *big.Int
+	nonce        []byte
+	server_nonce []byte
+	new_nonce    []byte
+	expires_in   int32
+}
+type TL_p_q_inner_data_dc struct {
+	pq           *big.Int
+	p            *big.Int
+	q            *big.Int
+	nonce        []byte
+	server_nonce []byte
+	new_nonce    []byte
+	dc           int32
+}
+type TL_p_q_inner_data_temp_dc struct {
+	pq           *big.Int
+	p            *big.Int
+	q            *big.Int
+	nonce        []byte
+	server_nonce []byte
+	new_nonce    []byte
+	dc           int32
+	expires_in   int32
+}
+type TL_bind_auth_key_inner struct {
+	nonce            int64
+	temp_auth_key_id int64
+	perm_auth_key_id int64
+	temp_session_id  int64
+	expires_at       int32
+}
 type TL_req_DH_params struct {
 	nonce        []byte
 	server_nonce []byte
@@ -105,12 +140,44 @@ type TL_rpc_error struct {
 	error_message string
 }
 
+type TL_rpc_drop_answer struct {
+	req_msg_id int64
+}
+
+type TL_rpc_answer_unknown struct{}
+
+type TL_rpc_answer_dropped_running struct{}
+
+type TL_rpc_answer_dropped struct {
+	msg_id int64
+	seq_no int32
+	bytes  int32
+}
+
+type TL_server_DH_params_fail struct {
+	nonce          []byte
+	server_nonce   []byte
+	new_nonce_hash []byte
+}
+
 type TL_dh_gen_ok struct {
 	nonce           []byte
 	server_nonce    []byte
 	new_nonce_hash1 []byte
 }
 
+type TL_dh_gen_retry struct {
+	nonce           []byte
+	server_nonce    []byte
+	new_nonce_hash2 []byte
+}
+
+type TL_dh_gen_fail struct {
+	nonce           []byte
+	server_nonce    []byte
+	new_nonce_hash3 []byte
+}
+
 type TL_ping struct {
 	ping_id int64
 }
@@ -119,3 +186,72 @@ type TL_pong struct {
 	msg_id  int64
 	ping_id int64
 }
+
+type TL_get_future_salts struct {
+	num int32
+}
+
+type TL_future_salt struct {
+	valid_since int32
+	valid_until int32
+	salt        []byte
+}
+
+type TL_future_salts struct {
+	req_msg_id int64
+	now        int32
+	salts      []TL_future_salt
+}
+
+type TL_msgs_state_req struct {
+	msg_ids []int64
+}
+
+type TL_msgs_state_info struct {
+	req_msg_id int64
+	info       []byte
+}
+
+type TL_msgs_all_info struct {
+	msg_ids []int64
+	info    []byte
+}
+
+type TL_msg_detailed_info struct {
+	msg_id        int64
+	answer_msg_id int64
+	bytes         int32
+	status        int32
+}
+
+type TL_msg_new_detailed_info struct {
+	answer_msg_id int64
+	bytes         int32
+	status        int32
+}
+
+type TL_msg_resend_req struct {
+	msg_ids []int64
+}
+
+type TL_msg_resend_ans_req struct {
+	msg_ids []int64
+}
+
+type TL_destroy_session struct {
+	session_id int64
+}
+
+type TL_destroy_session_ok struct {
+	session_id int64
+}
+
+type TL_destroy_session_none struct {
+	session_id int64
+}
+
+type TL_http_wait struct {
+	max_delay  int32
+	wait_after int32
+	max_wait   int32
+}
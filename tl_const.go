@@ -7,6 +7,10 @@ const (
 	crc_vector                     = 0x1cb5c415
 	crc_resPQ                      = 0x05162463
 	crc_p_q_inner_data             = 0x83c95aec
+	crc_p_q_inner_data_temp        = 0x3c6a84d4
+	crc_p_q_inner_data_dc          = 0xa9f55f95
+	crc_p_q_inner_data_temp_dc     = 0x56fddf88
+	crc_bind_auth_key_inner        = 0x75a3f765
 	crc_server_DH_params_fail      = 0x79cb045d
 	crc_server_DH_params_ok        = 0xd0e8075c
 	crc_server_DH_inner_data       = 0xb5890dba
@@ -32,6 +36,7 @@ const (
 	crc_bad_msg_notification       = 0xa7eff811
 	crc_bad_server_salt            = 0xedab447b
 	crc_msg_resend_req             = 0x7d861a08
+	crc_msg_resend_ans_req         = 0x8610baeb
 	crc_msgs_state_req             = 0xda69fb52
 	crc_msgs_state_info            = 0x04deb57d
 	crc_msgs_all_info              = 0x8cc0d131
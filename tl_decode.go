@@ -1,8 +1,6 @@
 package mtproto
 
 import (
-	"bytes"
-	"compress/gzip"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -300,6 +298,9 @@ func (m *DecodeBuf) Object() (r TL) {
 	case crc_server_DH_params_ok:
 		r = TL_server_DH_params_ok{m.Bytes(16), m.Bytes(16), m.StringBytes()}
 
+	case crc_server_DH_params_fail:
+		r = TL_server_DH_params_fail{m.Bytes(16), m.Bytes(16), m.Bytes(16)}
+
 	case crc_server_DH_inner_data:
 		r = TL_server_DH_inner_data{
 			m.Bytes(16), m.Bytes(16), m.Int(),
@@ -309,6 +310,12 @@ func (m *DecodeBuf) Object() (r TL) {
 	case crc_dh_gen_ok:
 		r = TL_dh_gen_ok{m.Bytes(16), m.Bytes(16), m.Bytes(16)}
 
+	case crc_dh_gen_retry:
+		r = TL_dh_gen_retry{m.Bytes(16), m.Bytes(16), m.Bytes(16)}
+
+	case crc_dh_gen_fail:
+		r = TL_dh_gen_fail{m.Bytes(16), m.Bytes(16), m.Bytes(16)}
+
 	case crc_ping:
 		r = TL_ping{m.Long()}
 
@@ -332,6 +339,15 @@ func (m *DecodeBuf) Object() (r TL) {
 	case crc_rpc_error:
 		r = TL_rpc_error{m.Int(), m.String()}
 
+	case crc_rpc_answer_unknown:
+		r = TL_rpc_answer_unknown{}
+
+	case crc_rpc_answer_dropped_running:
+		r = TL_rpc_answer_dropped_running{}
+
+	case crc_rpc_answer_dropped:
+		r = TL_rpc_answer_dropped{m.Long(), m.Int(), m.Int()}
+
 	case crc_new_session_created:
 		r = TL_new_session_created{m.Long(), m.Long(), m.Bytes(8)}
 
@@ -344,23 +360,53 @@ func (m *DecodeBuf) Object() (r TL) {
 	case crc_msgs_ack:
 		r = TL_msgs_ack{m.VectorLong()}
 
+	case crc_msgs_state_info:
+		r = TL_msgs_state_info{m.Long(), m.StringBytes()}
+
+	case crc_msgs_all_info:
+		r = TL_msgs_all_info{m.VectorLong(), m.StringBytes()}
+
+	case crc_msg_detailed_info:
+		r = TL_msg_detailed_info{m.Long(), m.Long(), m.Int(), m.Int()}
+
+	case crc_msg_new_detailed_info:
+		r = TL_msg_new_detailed_info{m.Long(), m.Int(), m.Int()}
+
+	case crc_destroy_session_ok:
+		r = TL_destroy_session_ok{m.Long()}
+
+	case crc_destroy_session_none:
+		r = TL_destroy_session_none{m.Long()}
+
+	case crc_future_salts:
+		// a bare vector of bare future_salt
+		reqMsgId, now, size := m.Long(), m.Int(), m.Int()
+		if m.err == nil && (size < 0 || int(size)*16 > m.size-m.off) {
+			m.err = errors.New("DecodeFutureSalts: Wrong size")
+			return nil
+		}
+		salts := make([]TL_future_salt, size)
+		for i := range salts {
+			salts[i] = TL_future_salt{m.Int(), m.Int(), m.Bytes(8)}
+		}
+		r = TL_future_salts{reqMsgId, now, salts}
+
 	case crc_gzip_packed:
-		obj := make([]byte, 0, 4096)
-
-		var buf bytes.Buffer
-		_, _ = buf.Write(m.StringBytes())
-		gz, _ := gzip.NewReader(&buf)
-
-		b := make([]byte, 4096)
-		for true {
-			n, _ := gz.Read(b)
-			obj = append(obj, b[0:n]...)
-			if n <= 0 {
-				break
-			}
+		packed := m.StringBytes()
+		if m.err != nil {
+			return nil
+		}
+		obj, err := gunzip(packed)
+		if err != nil {
+			m.err = fmt.Errorf("DecodeGzipPacked: %v", err)
+			return nil
 		}
 		d := NewDecodeBuf(obj)
 		r = d.Object()
+		if d.err != nil {
+			m.err = d.err
+			return nil
+		}
 
 	default:
 		r = m.ObjectGenerated(constructor)
@@ -14,11 +14,14 @@ func GenerateNonce(size int) []byte {
 	return b
 }
 
-func GenerateMessageId() int64 {
-	const nano = 1000 * 1000 * 1000
-	unixnano := time.Now().UnixNano()
+// randomLong returns a random int64 for session ids and other random ids.
+func randomLong() int64 {
+	return int64(binary.LittleEndian.Uint64(GenerateNonce(8)))
+}
 
-	return ((unixnano / nano) << 32) | ((unixnano % nano) & -4)
+// GenerateMessageId returns a msg_id from the local time.
+func GenerateMessageId() int64 {
+	return msgIdAt(time.Now())
 }
 
 type EncodeBuf struct {
@@ -124,16 +127,42 @@ func (e *EncodeBuf) Vector(v []TL) {
 	}
 }
 
-func (e TL_msg_container) encode() []byte            { return nil }
-func (e TL_resPQ) encode() []byte                    { return nil }
-func (e TL_server_DH_params_ok) encode() []byte      { return nil }
-func (e TL_server_DH_inner_data) encode() []byte     { return nil }
-func (e TL_dh_gen_ok) encode() []byte                { return nil }
-func (e TL_rpc_result) encode() []byte               { return nil }
-func (e TL_rpc_error) encode() []byte                { return nil }
-func (e TL_new_session_created) encode() []byte      { return nil }
-func (e TL_bad_server_salt) encode() []byte          { return nil }
-func (e TL_crc_bad_msg_notification) encode() []byte { return nil }
+func (e TL_resPQ) encode() []byte                      { return nil }
+func (e TL_server_DH_params_ok) encode() []byte        { return nil }
+func (e TL_server_DH_params_fail) encode() []byte      { return nil }
+func (e TL_server_DH_inner_data) encode() []byte       { return nil }
+func (e TL_dh_gen_ok) encode() []byte                  { return nil }
+func (e TL_dh_gen_retry) encode() []byte               { return nil }
+func (e TL_dh_gen_fail) encode() []byte                { return nil }
+func (e TL_rpc_result) encode() []byte                 { return nil }
+func (e TL_rpc_error) encode() []byte                  { return nil }
+func (e TL_rpc_answer_unknown) encode() []byte         { return nil }
+func (e TL_rpc_answer_dropped_running) encode() []byte { return nil }
+func (e TL_rpc_answer_dropped) encode() []byte         { return nil }
+func (e TL_new_session_created) encode() []byte        { return nil }
+func (e TL_bad_server_salt) encode() []byte            { return nil }
+func (e TL_crc_bad_msg_notification) encode() []byte   { return nil }
+func (e TL_future_salts) encode() []byte               { return nil }
+func (e TL_msgs_state_info) encode() []byte            { return nil }
+func (e TL_msgs_all_info) encode() []byte              { return nil }
+func (e TL_msg_detailed_info) encode() []byte          { return nil }
+func (e TL_msg_new_detailed_info) encode() []byte      { return nil }
+func (e TL_destroy_session_ok) encode() []byte         { return nil }
+func (e TL_destroy_session_none) encode() []byte       { return nil }
+
+func (e TL_msg_container) encode() []byte {
+	x := NewEncodeBuf(1024)
+	x.UInt(crc_msg_container)
+	x.Int(int32(len(e.items)))
+	for _, v := range e.items {
+		obj := v.data.(TL).encode()
+		x.Long(v.msg_id)
+		x.Int(v.seq_no)
+		x.Int(int32(len(obj)))
+		x.Bytes(obj)
+	}
+	return x.buf
+}
 
 func (e TL_req_pq) encode() []byte {
 	x := NewEncodeBuf(20)
@@ -154,6 +183,57 @@ func (e TL_p_q_inner_data) encode() []byte {
 	return x.buf
 }
 
+func (e TL_p_q_inner_data_temp) encode() []byte {
+	x := NewEncodeBuf(256)
+	x.UInt(crc_p_q_inner_data_temp)
+	x.BigInt(e.pq)
+	x.BigInt(e.p)
+	x.BigInt(e.q)
+	x.Bytes(e.nonce)
+	x.Bytes(e.server_nonce)
+	x.Bytes(e.new_nonce)
+	x.Int(e.expires_in)
+	return x.buf
+}
+
+func (e TL_p_q_inner_data_dc) encode() []byte {
+	x := NewEncodeBuf(256)
+	x.UInt(crc_p_q_inner_data_dc)
+	x.BigInt(e.pq)
+	x.BigInt(e.p)
+	x.BigInt(e.q)
+	x.Bytes(e.nonce)
+	x.Bytes(e.server_nonce)
+	x.Bytes(e.new_nonce)
+	x.Int(e.dc)
+	return x.buf
+}
+
+func (e TL_p_q_inner_data_temp_dc) encode() []byte {
+	x := NewEncodeBuf(256)
+	x.UInt(crc_p_q_inner_data_temp_dc)
+	x.BigInt(e.pq)
+	x.BigInt(e.p)
+	x.BigInt(e.q)
+	x.Bytes(e.nonce)
+	x.Bytes(e.server_nonce)
+	x.Bytes(e.new_nonce)
+	x.Int(e.dc)
+	x.Int(e.expires_in)
+	return x.buf
+}
+
+func (e TL_bind_auth_key_inner) encode() []byte {
+	x := NewEncodeBuf(64)
+	x.UInt(crc_bind_auth_key_inner)
+	x.Long(e.nonce)
+	x.Long(e.temp_auth_key_id)
+	x.Long(e.perm_auth_key_id)
+	x.Long(e.temp_session_id)
+	x.Int(e.expires_at)
+	return x.buf
+}
+
 func (e TL_req_DH_params) encode() []byte {
 	x := NewEncodeBuf(512)
 	x.UInt(crc_req_DH_params)
@@ -185,6 +265,13 @@ func (e TL_set_client_DH_params) encode() []byte {
 	return x.buf
 }
 
+func (e TL_rpc_drop_answer) encode() []byte {
+	x := NewEncodeBuf(12)
+	x.UInt(crc_rpc_drop_answer)
+	x.Long(e.req_msg_id)
+	return x.buf
+}
+
 func (e TL_ping) encode() []byte {
 	x := NewEncodeBuf(32)
 	x.UInt(crc_ping)
@@ -206,3 +293,47 @@ func (e TL_msgs_ack) encode() []byte {
 	x.VectorLong(e.msgIds)
 	return x.buf
 }
+
+func (e TL_get_future_salts) encode() []byte {
+	x := NewEncodeBuf(8)
+	x.UInt(crc_get_future_salts)
+	x.Int(e.num)
+	return x.buf
+}
+
+func (e TL_msgs_state_req) encode() []byte {
+	x := NewEncodeBuf(64)
+	x.UInt(crc_msgs_state_req)
+	x.VectorLong(e.msg_ids)
+	return x.buf
+}
+
+func (e TL_msg_resend_req) encode() []byte {
+	x := NewEncodeBuf(64)
+	x.UInt(crc_msg_resend_req)
+	x.VectorLong(e.msg_ids)
+	return x.buf
+}
+
+func (e TL_msg_resend_ans_req) encode() []byte {
+	x := NewEncodeBuf(64)
+	x.UInt(crc_msg_resend_ans_req)
+	x.VectorLong(e.msg_ids)
+	return x.buf
+}
+
+func (e TL_destroy_session) encode() []byte {
+	x := NewEncodeBuf(12)
+	x.UInt(crc_destroy_session)
+	x.Long(e.session_id)
+	return x.buf
+}
+
+func (e TL_http_wait) encode() []byte {
+	x := NewEncodeBuf(16)
+	x.UInt(crc_http_wait)
+	x.Int(e.max_delay)
+	x.Int(e.wait_after)
+	x.Int(e.max_wait)
+	return x.buf
+}
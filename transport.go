@@ -0,0 +1,237 @@
+package mtproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// maxPacketSize limits the size of a single incoming frame.
+const maxPacketSize = 16 * 1024 * 1024
+
+// Transport frames MTProto packets on top of a byte stream.
+// Transports may keep per-connection state, so a new one is created for every connection.
+type Transport interface {
+	// Init writes the marker which selects the transport on a new connection.
+	Init(w io.Writer) error
+	// WritePacket frames data and writes it with a single Write call.
+	// With quickAck the server is asked to confirm the receipt with a short token;
+	// transports which can't do it ignore the flag.
+	WritePacket(w io.Writer, data []byte, quickAck bool) error
+	// ReadPacket reads the next frame and returns its payload,
+	// or a nil payload and the token of a quick ack.
+	ReadPacket(r io.Reader) ([]byte, uint32, error)
+}
+
+// taggedTransport is implemented by transports which can be carried by the obfuscated transport.
+type taggedTransport interface {
+	protocolTag() []byte
+}
+
+// https://core.telegram.org/mtproto/mtproto-transports#abridged
+type abridgedTransport struct{}
+
+func NewAbridgedTransport() Transport {
+	return &abridgedTransport{}
+}
+
+func (t *abridgedTransport) Init(w io.Writer) error {
+	_, err := w.Write([]byte{0xef})
+	return err
+}
+
+func (t *abridgedTransport) protocolTag() []byte {
+	return []byte{0xef, 0xef, 0xef, 0xef}
+}
+
+func (t *abridgedTransport) WritePacket(w io.Writer, data []byte, quickAck bool) error {
+	if len(data)%4 != 0 {
+		return fmt.Errorf("Abridged: packet size %d is not divisible by 4", len(data))
+	}
+
+	var x []byte
+	size := len(data) / 4
+	if size < 127 {
+		x = make([]byte, 1, 1+len(data))
+		x[0] = byte(size)
+	} else {
+		x = make([]byte, 4, 4+len(data))
+		binary.LittleEndian.PutUint32(x, uint32(size<<8|127))
+	}
+	if quickAck {
+		x[0] |= 0x80
+	}
+	x = append(x, data...)
+
+	_, err := w.Write(x)
+	return err
+}
+
+func (t *abridgedTransport) ReadPacket(r io.Reader) ([]byte, uint32, error) {
+	b := make([]byte, 4)
+	_, err := io.ReadFull(r, b[:1])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var size int
+	switch {
+	case b[0]&0x80 != 0:
+		// quick ack, 4 bytes big endian
+		_, err = io.ReadFull(r, b[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		return nil, binary.BigEndian.Uint32(b), nil
+	case b[0] < 127:
+		size = int(b[0]) << 2
+	default:
+		_, err = io.ReadFull(r, b[:3])
+		if err != nil {
+			return nil, 0, err
+		}
+		size = (int(b[0]) | int(b[1])<<8 | int(b[2])<<16) << 2
+	}
+
+	x, err := readPayload(r, size)
+	return x, 0, err
+}
+
+// https://core.telegram.org/mtproto/mtproto-transports#intermediate
+type intermediateTransport struct {
+	padded bool
+}
+
+func NewIntermediateTransport() Transport {
+	return &intermediateTransport{false}
+}
+
+// NewPaddedIntermediateTransport returns the intermediate transport which
+// appends 0-15 random bytes to every packet to hide its real size.
+func NewPaddedIntermediateTransport() Transport {
+	return &intermediateTransport{true}
+}
+
+func (t *intermediateTransport) Init(w io.Writer) error {
+	_, err := w.Write(t.protocolTag())
+	return err
+}
+
+func (t *intermediateTransport) protocolTag() []byte {
+	if t.padded {
+		return []byte{0xdd, 0xdd, 0xdd, 0xdd}
+	}
+	return []byte{0xee, 0xee, 0xee, 0xee}
+}
+
+func (t *intermediateTransport) WritePacket(w io.Writer, data []byte, quickAck bool) error {
+	var padding []byte
+	if t.padded {
+		padding = GenerateNonce(int(GenerateNonce(1)[0] & 15))
+	}
+
+	x := make([]byte, 4, 4+len(data)+len(padding))
+	size := uint32(len(data) + len(padding))
+	if quickAck {
+		size |= 0x80000000
+	}
+	binary.LittleEndian.PutUint32(x, size)
+	x = append(x, data...)
+	x = append(x, padding...)
+
+	_, err := w.Write(x)
+	return err
+}
+
+func (t *intermediateTransport) ReadPacket(r io.Reader) ([]byte, uint32, error) {
+	b := make([]byte, 4)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size := binary.LittleEndian.Uint32(b)
+	if size&0x80000000 != 0 {
+		return nil, size, nil
+	}
+	x, err := readPayload(r, int(size))
+	return x, 0, err
+}
+
+// https://core.telegram.org/mtproto/mtproto-transports#full
+type fullTransport struct {
+	sendSeqNo int32
+	readSeqNo int32
+}
+
+func NewFullTransport() Transport {
+	return &fullTransport{}
+}
+
+func (t *fullTransport) Init(w io.Writer) error {
+	// the full transport has no marker
+	return nil
+}
+
+func (t *fullTransport) WritePacket(w io.Writer, data []byte, quickAck bool) error {
+	// the full transport has no quick acks
+	x := make([]byte, 8, 12+len(data))
+	binary.LittleEndian.PutUint32(x, uint32(12+len(data)))
+	binary.LittleEndian.PutUint32(x[4:], uint32(t.sendSeqNo))
+	x = append(x, data...)
+	x = append(x, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(x[len(x)-4:], crc32.ChecksumIEEE(x[:len(x)-4]))
+
+	_, err := w.Write(x)
+	if err != nil {
+		return err
+	}
+	t.sendSeqNo++
+
+	return nil
+}
+
+func (t *fullTransport) ReadPacket(r io.Reader) ([]byte, uint32, error) {
+	b := make([]byte, 8)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size := int(binary.LittleEndian.Uint32(b))
+	if size < 12 {
+		return nil, 0, fmt.Errorf("Full: wrong packet size %d", size)
+	}
+	x, err := readPayload(r, size-8)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(b)
+	_, _ = crc.Write(x[:len(x)-4])
+	if crc.Sum32() != binary.LittleEndian.Uint32(x[len(x)-4:]) {
+		return nil, 0, errors.New("Full: wrong CRC32")
+	}
+	seqNo := int32(binary.LittleEndian.Uint32(b[4:]))
+	if seqNo != t.readSeqNo {
+		return nil, 0, fmt.Errorf("Full: wrong seq_no %d (need %d)", seqNo, t.readSeqNo)
+	}
+	t.readSeqNo++
+
+	return x[:len(x)-4], 0, nil
+}
+
+func readPayload(r io.Reader, size int) ([]byte, error) {
+	if size < 0 || size > maxPacketSize {
+		return nil, fmt.Errorf("Wrong packet size: %d", size)
+	}
+	buf := make([]byte, size)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
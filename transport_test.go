@@ -0,0 +1,96 @@
+package mtproto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTransportRoundTrip(t *testing.T) {
+	transports := map[string]func() Transport{
+		"abridged":            NewAbridgedTransport,
+		"intermediate":        NewIntermediateTransport,
+		"padded intermediate": NewPaddedIntermediateTransport,
+		"full":                NewFullTransport,
+	}
+	packets := [][]byte{
+		GenerateNonce(4),
+		GenerateNonce(504),
+		GenerateNonce(508),
+		GenerateNonce(4096),
+	}
+
+	for name, newTransport := range transports {
+		var buf bytes.Buffer
+		w, r := newTransport(), newTransport()
+		for _, p := range packets {
+			if err := w.WritePacket(&buf, p, false); err != nil {
+				t.Fatalf("%s: write failed: %s", name, err)
+			}
+		}
+		for _, p := range packets {
+			x, _, err := r.ReadPacket(&buf)
+			if err != nil {
+				t.Fatalf("%s: read failed: %s", name, err)
+			}
+			if name == "padded intermediate" {
+				if len(x) < len(p) || len(x) > len(p)+15 {
+					t.Fatalf("%s: wrong padding: %d bytes for %d", name, len(x), len(p))
+				}
+				x = x[:len(p)]
+			}
+			if !bytes.Equal(x, p) {
+				t.Fatalf("%s: packet mismatch", name)
+			}
+		}
+	}
+}
+
+func TestFullTransportCorruption(t *testing.T) {
+	var buf bytes.Buffer
+	err := NewFullTransport().WritePacket(&buf, GenerateNonce(64), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Bytes()[20] ^= 0x01
+
+	_, _, err = NewFullTransport().ReadPacket(&buf)
+	if err == nil {
+		t.Error("Corrupted packet accepted")
+	}
+}
+
+func TestTransportQuickAck(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewAbridgedTransport().WritePacket(&buf, GenerateNonce(8), true); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Bytes()[0] != 0x82 {
+		t.Errorf("Abridged: length byte %#x", buf.Bytes()[0])
+	}
+	buf.Reset()
+	if err := NewIntermediateTransport().WritePacket(&buf, GenerateNonce(8), true); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes()[:4], []byte{8, 0, 0, 0x80}) {
+		t.Errorf("Intermediate: length %x", buf.Bytes()[:4])
+	}
+
+	// the tokens the server sends back
+	tokens := map[string][]byte{
+		"abridged":     {0x91, 0x22, 0x33, 0x44},
+		"intermediate": {0x44, 0x33, 0x22, 0x91},
+	}
+	for name, b := range tokens {
+		var x []byte
+		var token uint32
+		var err error
+		if name == "abridged" {
+			x, token, err = NewAbridgedTransport().ReadPacket(bytes.NewReader(b))
+		} else {
+			x, token, err = NewIntermediateTransport().ReadPacket(bytes.NewReader(b))
+		}
+		if err != nil || x != nil || token != 0x91223344 {
+			t.Errorf("%s: got %x, %#x, %v", name, x, token, err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package mtproto
+
+// handleUpdates applies the updates which change the connection state.
+func (m *MTProto) handleUpdates(x TL) {
+	var list []TL
+	switch x := x.(type) {
+	case TL_updates:
+		list = x.updates
+	case TL_updatesCombined:
+		list = x.updates
+	case TL_updateShort:
+		list = []TL{x.update}
+	}
+
+	for _, v := range list {
+		switch v := v.(type) {
+		case TL_updateDcOptions:
+			m.dcs.merge(v.dc_options)
+		case TL_updateConfig:
+			go m.refreshConfig()
+		}
+	}
+}
+
+// updatesGap tells the application that updates may have been lost.
+func (m *MTProto) updatesGap() {
+	if m.onUpdatesGap != nil {
+		go m.onUpdatesGap()
+	}
+}
+
+// refreshConfig reloads dc_options after the server announced a config change.
+func (m *MTProto) refreshConfig() {
+	resp := make(chan TL, 1)
+	if !m.enqueue(packetToSend{TL_help_getConfig{}, resp}) {
+		// the connection is being stopped, the next updateConfig refreshes it
+		return
+	}
+	m.applyConfig(resp)
+}
@@ -0,0 +1,26 @@
+package mtproto
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRefreshConfigStopped(t *testing.T) {
+	m := newTestMTProto(nil)
+	m.stop = make(chan struct{})
+	close(m.stop)
+	for len(m.queueSend) < cap(m.queueSend) {
+		m.queueSend <- packetToSend{TL_ping{0}, nil}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.refreshConfig()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("refreshConfig blocks on a full queue while stopping")
+	}
+}
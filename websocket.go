@@ -0,0 +1,221 @@
+package mtproto
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	wsContinuation = 0x0
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// webDCs are the names of the DC hosts under web.telegram.org. The certificates for
+// WebSocket over TLS are issued for them, not for the DC addresses.
+var webDCs = map[int32]string{
+	1: "pluto",
+	2: "venus",
+	3: "aurora",
+	4: "vesta",
+	5: "flora",
+}
+
+// webSocketAddr returns the address of the DC dcId for WebSocket over TLS.
+func webSocketAddr(dcId int32) (string, error) {
+	name, ok := webDCs[dcId]
+	if !ok {
+		return "", fmt.Errorf("WebSocket: no host for DC %d", dcId)
+	}
+	return name + ".web.telegram.org:443", nil
+}
+
+// wsConn is a client side WebSocket connection (RFC 6455) exposed as a byte stream.
+// Every Write is sent as one binary message.
+type wsConn struct {
+	net.Conn
+	r       *bufio.Reader
+	pending []byte
+	wmutex  sync.Mutex
+}
+
+// dialWebSocket connects to scheme://addr/apiws the way the official web clients do.
+func dialWebSocket(ctx context.Context, dial DialContextFunc, scheme, addr string) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "wss" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		conn = tls.Client(conn, &tls.Config{ServerName: host})
+	}
+
+	c := &wsConn{Conn: conn, r: bufio.NewReader(conn)}
+	err = withDeadline(ctx, conn, func() error {
+		return c.handshake(addr)
+	})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *wsConn) handshake(addr string) error {
+	key := base64.StdEncoding.EncodeToString(GenerateNonce(16))
+	req := "GET /apiws HTTP/1.1\r\n" +
+		"Host: " + addr + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Protocol: binary\r\n\r\n"
+	_, err := io.WriteString(c.Conn, req)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(c.r, &http.Request{Method: "GET"})
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("WebSocket: %s", resp.Status)
+	}
+	accept := base64.StdEncoding.EncodeToString(sha1([]byte(key + wsGUID)))
+	if resp.Header.Get("Sec-WebSocket-Accept") != accept {
+		return errors.New("WebSocket: wrong Sec-WebSocket-Accept")
+	}
+
+	return nil
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	err := c.writeFrame(wsBinary, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	x := make([]byte, 2, 14+len(payload))
+	x[0] = 0x80 | opcode
+	switch size := len(payload); {
+	case size < 126:
+		x[1] = 0x80 | byte(size)
+	case size < 1<<16:
+		x[1] = 0x80 | 126
+		x = append(x, byte(size>>8), byte(size))
+	default:
+		x[1] = 0x80 | 127
+		x = append(x, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(x[len(x)-8:], uint64(size))
+	}
+
+	// client frames are always masked
+	mask := GenerateNonce(4)
+	x = append(x, mask...)
+	for i, v := range payload {
+		x = append(x, v^mask[i&3])
+	}
+
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	_, err := c.Conn.Write(x)
+	return err
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, err
+		}
+
+		switch opcode {
+		case wsBinary, wsContinuation:
+			c.pending = payload
+		case wsPing:
+			err = c.writeFrame(wsPong, payload)
+			if err != nil {
+				return 0, err
+			}
+		case wsPong:
+			// (ignore)
+		case wsClose:
+			return 0, io.EOF
+		default:
+			return 0, fmt.Errorf("WebSocket: unexpected opcode 0x%x", opcode)
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(c.r, header[:2])
+	if err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		_, err = io.ReadFull(c.r, header[:2])
+		size = uint64(binary.BigEndian.Uint16(header))
+	case 127:
+		_, err = io.ReadFull(c.r, header)
+		size = binary.BigEndian.Uint64(header)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > maxPacketSize {
+		return 0, nil, fmt.Errorf("WebSocket: frame too large (%d)", size)
+	}
+
+	var mask []byte
+	if masked {
+		mask = make([]byte, 4)
+		_, err = io.ReadFull(c.r, mask)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(c.r, payload)
+	if err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+	}
+
+	return opcode, payload, nil
+}
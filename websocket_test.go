@@ -0,0 +1,118 @@
+package mtproto
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// wsEchoHandler answers every binary message with the same payload, preceded by a ping.
+func wsEchoHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/apiws" || r.Header.Get("Sec-WebSocket-Protocol") != "binary" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		key := r.Header.Get("Sec-WebSocket-Key")
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(sha1([]byte(key+wsGUID))))
+		w.WriteHeader(http.StatusSwitchingProtocols)
+
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		// the server side reuses the client framing code; masking is optional for readers
+		c := &wsConn{Conn: conn, r: brw.Reader}
+		for {
+			opcode, payload, err := c.readFrame()
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case wsBinary:
+				conn.Write([]byte{0x80 | wsPing, 0x00})
+				conn.Write(append([]byte{0x80 | wsBinary, byte(len(payload))}, payload...))
+			case wsPong:
+				// (ignore)
+			default:
+				return
+			}
+		}
+	})
+}
+
+func TestWebSocketConn(t *testing.T) {
+	server := httptest.NewServer(wsEchoHandler(t))
+	defer server.Close()
+
+	addr := strings.TrimPrefix(server.URL, "http://")
+	conn, err := dialWebSocket(context.Background(), defaultDialer(nil), "ws", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, msg := range []string{"hello", "world"} {
+		if _, err = conn.Write([]byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(msg))
+		if _, err = io.ReadFull(conn, b); err != nil || string(b) != msg {
+			t.Fatalf("Got %q %v", b, err)
+		}
+	}
+}
+
+func TestWebSocketObfuscated(t *testing.T) {
+	var header []byte
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(sha1([]byte(r.Header.Get("Sec-WebSocket-Key")+wsGUID))))
+		w.WriteHeader(http.StatusSwitchingProtocols)
+		conn, brw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		_, header, _ = (&wsConn{Conn: conn, r: brw.Reader}).readFrame()
+		close(done)
+	}))
+	defer server.Close()
+
+	m := &MTProto{
+		addr:         strings.TrimPrefix(server.URL, "http://"),
+		newTransport: NewAbridgedTransport,
+		dial:         defaultDialer(nil),
+		wsScheme:     "ws",
+		dcs:          newDcTable(),
+	}
+	conn, err := m.dialConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	<-done
+	if len(header) != 64 {
+		t.Fatalf("Got %d bytes instead of the obfuscated header", len(header))
+	}
+	if _, ok := conn.(*streamConn).Conn.(*wsConn); !ok {
+		t.Error("Not a WebSocket connection")
+	}
+}
+
+func TestWebSocketAddr(t *testing.T) {
+	addr, err := webSocketAddr(2)
+	if err != nil || addr != "venus.web.telegram.org:443" {
+		t.Errorf("Got %q %v", addr, err)
+	}
+	if _, err = webSocketAddr(7); err == nil {
+		t.Error("Address of an unknown DC")
+	}
+}